@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"jrmtan/server"
+)
+
+// config looks settings up by name in the environment, falling back to
+// the key=value file named by CONFIG_FILE. The file is read once, when
+// the config is loaded.
+type config struct {
+	file map[string]string
+}
+
+// loadConfig reads CONFIG_FILE, if set.
+func loadConfig() (*config, error) {
+	c := &config{file: make(map[string]string)}
+
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return c, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key=value", path, n)
+		}
+		c.file[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// get returns the value of key, or "" if it is not set.
+func (c *config) get(key string) string {
+	v, _ := c.lookup(key)
+	return v
+}
+
+// lookup returns the value of key and where it was found: "env" or
+// "file". The source is "" if key is not set.
+func (c *config) lookup(key string) (value, source string) {
+	if v, ok := os.LookupEnv(key); ok {
+		return v, "env"
+	}
+	if v, ok := c.file[key]; ok {
+		return v, "file"
+	}
+	return "", ""
+}
+
+// attr returns a log attribute describing the value in effect for key,
+// with def standing in for an empty value, and its source.
+func (c *config) attr(key, def string) slog.Attr {
+	value, source := c.lookup(key)
+	if value == "" {
+		value, source = def, "default"
+	}
+	return slog.Group(strings.ToLower(key), "value", value, "source", source)
+}
+
+// configure applies the settings from c to srv.
+func configure(srv *server.Server, c *config) error {
+	st, err := c.settings()
+	if err != nil {
+		return err
+	}
+	srv.IdleTimeout = st.IdleTimeout
+	srv.RateLimit = st.RateLimit
+	srv.AllowCIDRs = st.AllowCIDRs
+	srv.DenyCIDRs = st.DenyCIDRs
+
+	if srv.WriteTimeout, err = c.duration("WRITE_TIMEOUT"); err != nil {
+		return err
+	}
+	if srv.HandshakeTimeout, err = c.duration("HANDSHAKE_TIMEOUT"); err != nil {
+		return err
+	}
+	if srv.MaxConnLifetime, err = c.duration("MAX_CONN_LIFETIME"); err != nil {
+		return err
+	}
+	if srv.KeepAlivePeriod, err = c.duration("KEEPALIVE_PERIOD"); err != nil {
+		return err
+	}
+
+	if srv.Listeners, err = c.int("LISTENERS"); err != nil {
+		return err
+	}
+
+	if srv.MaxConns, err = c.int("MAX_CONNS"); err != nil {
+		return err
+	}
+	srv.RejectWhenFull = c.get("MAX_CONNS_REJECT") == "1"
+	srv.FastEcho = c.get("FAST_ECHO") == "1"
+	srv.Echo = c.get("ECHO") == "1" || srv.FastEcho
+	srv.ProxyProtocol = c.get("PROXY_PROTOCOL") == "1"
+	noDelay, err := c.bool("TCP_NODELAY", true)
+	if err != nil {
+		return err
+	}
+	srv.DisableNoDelay = !noDelay
+	srv.DetectHTTP = c.get("DETECT_HTTP") == "1"
+	srv.Banner = c.get("BANNER")
+	// With DETECT_HTTP the server waits for the client to speak first,
+	// while a client that expects a banner waits for the server, so
+	// neither would send anything.
+	if srv.DetectHTTP && srv.Banner != "" {
+		return fmt.Errorf("BANNER and DETECT_HTTP cannot be used together")
+	}
+
+	if srv.WriteQueueDepth, err = c.int("WRITE_QUEUE_DEPTH"); err != nil {
+		return err
+	}
+
+	maxBytes, err := c.int("MAX_CONN_BYTES")
+	if err != nil {
+		return err
+	}
+	srv.MaxConnBytes = int64(maxBytes)
+
+	minRate, err := c.int("MIN_RATE_BYTES_PER_SEC")
+	if err != nil {
+		return err
+	}
+	srv.MinRate = int64(minRate)
+	if srv.MinRateWindow, err = c.duration("MIN_RATE_WINDOW"); err != nil {
+		return err
+	}
+	if srv.MinRateInterval, err = c.duration("MIN_RATE_INTERVAL"); err != nil {
+		return err
+	}
+
+	if srv.ReadBufferSize, err = c.int("READ_BUFFER_SIZE"); err != nil {
+		return err
+	}
+	if v := c.get("READ_BUFFER_SIZE"); v != "" && srv.ReadBufferSize == 0 {
+		return fmt.Errorf("invalid READ_BUFFER_SIZE: %q", v)
+	}
+
+	if c.get("LINE_MODE") == "1" {
+		srv.LineHandler = func(conn net.Conn, line []byte) {
+			server.Logger.Info("line received", "event", "line", "conn_id", server.ConnID(conn), "remote_addr", conn.RemoteAddr().String(), "line", string(line))
+		}
+	}
+	srv.PingPong = c.get("PING_PONG") == "1"
+	if srv.MaxLineLength, err = c.int("MAX_LINE_LENGTH"); err != nil {
+		return err
+	}
+	if c.get("CHAT") == "1" {
+		hub := server.NewHub()
+		hub.MaxLineLength = srv.MaxLineLength
+		srv.Handler = hub
+	}
+
+	if c.get("JSON_MODE") == "1" {
+		srv.JSONHandlers = map[string]func(net.Conn, json.RawMessage){
+			"echo": func(conn net.Conn, msg json.RawMessage) {
+				reply := make([]byte, len(msg)+1)
+				copy(reply, msg)
+				reply[len(msg)] = '\n'
+				server.Enqueue(conn, reply)
+			},
+		}
+		srv.StrictJSON = c.get("JSON_STRICT") == "1"
+	}
+
+	if c.get("FRAME_MODE") == "1" {
+		srv.FrameHandler = func(conn net.Conn, payload []byte) {
+			server.Logger.Info("frame received", "event", "frame", "conn_id", server.ConnID(conn), "remote_addr", conn.RemoteAddr().String(), "bytes", len(payload))
+		}
+	}
+	if srv.MaxFrameSize, err = c.int("MAX_FRAME_SIZE"); err != nil {
+		return err
+	}
+	if c.get("RPC_MODE") == "1" {
+		srv.Handler = server.HandlerFunc(func(ctx context.Context, conn net.Conn) {
+			server.Serve(conn, func(req []byte) ([]byte, error) {
+				return req, nil
+			})
+		})
+	}
+	if srv.RequestTimeout, err = c.duration("REQUEST_TIMEOUT"); err != nil {
+		return err
+	}
+
+	if srv.TLSConfig, err = c.tls(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// settings returns the settings that can be reloaded on SIGHUP.
+func (c *config) settings() (server.Settings, error) {
+	var st server.Settings
+	var err error
+
+	if st.IdleTimeout, err = c.duration("IDLE_TIMEOUT"); err != nil {
+		return st, err
+	}
+	if st.RateLimit, err = c.float("RATE_LIMIT"); err != nil {
+		return st, err
+	}
+	if st.AllowCIDRs, err = c.cidrs("ALLOW_CIDRS"); err != nil {
+		return st, err
+	}
+	if st.DenyCIDRs, err = c.cidrs("DENY_CIDRS"); err != nil {
+		return st, err
+	}
+	return st, nil
+}
+
+// newLogger builds the logger described by LOG_FORMAT ("text" or
+// "json", default text) and LOG_LEVEL (default info).
+func newLogger(c *config) (*slog.Logger, error) {
+	var level slog.Level
+	if v := c.get("LOG_LEVEL"); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			return nil, fmt.Errorf("invalid LOG_LEVEL: %q", v)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	switch v := c.get("LOG_FORMAT"); v {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(os.Stdout, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stdout, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid LOG_FORMAT: %q", v)
+	}
+}
+
+// tls loads the certificate and key named by TLS_CERT and TLS_KEY. It
+// returns a nil config when neither is set.
+func (c *config) tls() (*tls.Config, error) {
+	certFile := c.get("TLS_CERT")
+	keyFile := c.get("TLS_KEY")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("TLS_CERT and TLS_KEY must be set together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS key pair: %w", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// bool parses the boolean in key, such as "1", "0", "true" or "false".
+// An unset or empty value yields def.
+func (c *config) bool(key string, def bool) (bool, error) {
+	v := c.get(key)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %q", key, v)
+	}
+	return b, nil
+}
+
+// duration parses the duration in key. An unset or empty value yields
+// zero.
+func (c *config) duration(key string) (time.Duration, error) {
+	v := c.get(key)
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return d, nil
+}
+
+// float parses the number in key. An unset or empty value yields zero.
+func (c *config) float(key string) (float64, error) {
+	v := c.get(key)
+	if v == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid %s: %q", key, v)
+	}
+	return f, nil
+}
+
+// cidrs parses the comma-separated CIDR blocks in key.
+func (c *config) cidrs(key string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range strings.Split(c.get(key), ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", key, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// int parses the integer in key. An unset or empty value yields zero.
+func (c *config) int(key string) (int, error) {
+	v := c.get(key)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s: %q", key, v)
+	}
+	return n, nil
+}
@@ -1,47 +1,161 @@
-package main 
+package main
 
 import (
-	"net"
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"jrmtan/server"
 )
 
-func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "10000"
-	}
+const shutdownTimeout = 10 * time.Second
 
-	fmt.Printf("starting server: %s\n", port)
+// defaultPort is the port listened on when neither PORT nor PORTS is set.
+const defaultPort = "10000"
 
-	listener, err := net.Listen("tcp", ":"+port)
+func main() {
+	cfg, err := loadConfig()
 	if err != nil {
-		fmt.Println("Error listening:", err.Error())
-		return
+		server.Logger.Error("invalid configuration", "event", "config", "error", err)
+		os.Exit(1)
+	}
+	logger, err := newLogger(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err.Error())
+		os.Exit(1)
 	}
+	server.Logger = logger
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			fmt.Println("Error accepting: ", err.Error())
-			continue
+	ports := []string{cfg.get("PORT")}
+	if ports[0] == "" {
+		ports[0] = defaultPort
+	}
+	if s := cfg.get("PORTS"); s != "" {
+		ports = strings.Split(s, ",")
+	}
+	var addrs []string
+	for _, port := range ports {
+		port = strings.TrimSpace(port)
+		if port == "" {
+			logger.Error("invalid configuration", "event", "config", "error", fmt.Sprintf("invalid PORTS: %q", cfg.get("PORTS")))
+			os.Exit(1)
 		}
+		addrs = append(addrs, net.JoinHostPort(cfg.get("BIND_ADDR"), port))
+	}
 
-		go handleClient(conn)
+	network, addr := "tcp", addrs[0]
+	switch family := cfg.get("NETWORK"); family {
+	case "", "tcp":
+	case "tcp4", "tcp6":
+		network = family
+	default:
+		logger.Error("invalid configuration", "event", "config", "error", fmt.Sprintf("invalid NETWORK: %q (want tcp, tcp4 or tcp6)", family))
+		os.Exit(1)
+	}
+	switch proto := cfg.get("PROTO"); proto {
+	case "", "tcp":
+	case "udp":
+		// Keep the address family chosen by NETWORK.
+		network = "udp" + strings.TrimPrefix(network, "tcp")
+	default:
+		logger.Error("invalid configuration", "event", "config", "error", fmt.Sprintf("invalid PROTO: %q", proto))
+		os.Exit(1)
+	}
+	if path := cfg.get("UNIX_SOCKET"); path != "" {
+		network, addr = "unix", path
+	}
+	if !strings.HasPrefix(network, "tcp") {
+		addrs = addrs[:1]
 	}
-}
 
-func handleClient(conn net.Conn) {
-	defer conn.Close()
+	logger.Info("starting server", "event", "start", "network", network, "addr", addr)
 
-	remoteaddr := conn.RemoteAddr().String()
-	fmt.Printf("real client connected: %s\n", remoteaddr)
+	srv := server.NewServer(addr)
+	srv.Network = network
+	srv.Addrs = addrs[1:]
+	if port := cfg.get("METRICS_PORT"); port != "" {
+		srv.MetricsAddr = net.JoinHostPort(cfg.get("BIND_ADDR"), port)
+	}
+	if port := cfg.get("ADMIN_PORT"); port != "" {
+		srv.AdminAddr = net.JoinHostPort(cfg.get("BIND_ADDR"), port)
+	}
+	if err := configure(srv, cfg); err != nil {
+		logger.Error("invalid configuration", "event", "config", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("effective configuration",
+		"event", "config",
+		"config_file", os.Getenv("CONFIG_FILE"),
+		cfg.attr("PORT", defaultPort),
+		cfg.attr("PORTS", ""),
+		cfg.attr("BIND_ADDR", ""),
+		cfg.attr("IDLE_TIMEOUT", "0"),
+		cfg.attr("MAX_CONNS", "0"),
+		cfg.attr("TCP_NODELAY", "1"),
+		cfg.attr("LISTENERS", "1"))
+	logger.Info("tls", "event", "config", "enabled", srv.TLSConfig != nil)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
 
-	buffer := make([]byte, 1024)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Start()
+	}()
+
+wait:
 	for {
-		_, err := conn.Read(buffer)
-		if err != nil {
-			fmt.Printf("client disconnected: %s\n", remoteaddr)
+		select {
+		case err := <-errc:
+			logger.Error("error listening", "event", "listen", "error", err)
+			os.Exit(1)
+		case sig := <-sigs:
+			switch sig {
+			case syscall.SIGHUP:
+				reload(srv)
+				continue
+			case syscall.SIGUSR1:
+				srv.Drain()
+				continue
+			}
+			logger.Info("shutting down", "event", "shutdown", "signal", sig.String())
+			break wait
 		}
 	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Stop(ctx); err != nil {
+		cancel()
+		os.Exit(1)
+	}
+	if err := <-errc; !errors.Is(err, server.ErrServerClosed) {
+		logger.Error("error serving", "event", "serve", "error", err)
+		os.Exit(1)
+	}
+
+	logger.Info("server stopped", "event", "stop")
+}
+
+// reload re-reads the configuration and applies the settings that can be
+// changed at runtime. On error the current settings are kept.
+func reload(srv *server.Server) {
+	cfg, err := loadConfig()
+	if err != nil {
+		server.Logger.Error("error reloading configuration", "event", "reload", "error", err)
+		return
+	}
+	st, err := cfg.settings()
+	if err != nil {
+		server.Logger.Error("error reloading configuration", "event", "reload", "error", err)
+		return
+	}
+	srv.Reload(st)
 }
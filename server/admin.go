@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// auxTimeout bounds how long a metrics or admin client may take.
+const auxTimeout = 5 * time.Second
+
+// auxListener is a secondary listener serving operational data. Each
+// connection is handled inline by serve and then closed.
+type auxListener struct {
+	net.Listener
+	name  string
+	serve func(conn net.Conn)
+}
+
+// listenAux opens the metrics and admin listeners that are configured.
+func (s *Server) listenAux() ([]auxListener, error) {
+	configured := []struct {
+		addr string
+		aux  auxListener
+	}{
+		{s.MetricsAddr, auxListener{name: "metrics", serve: s.writeMetrics}},
+		{s.AdminAddr, auxListener{name: "admin", serve: s.serveAdmin}},
+	}
+
+	var ls []auxListener
+	for _, c := range configured {
+		if c.addr == "" {
+			continue
+		}
+
+		l, err := net.Listen("tcp", c.addr)
+		if err != nil {
+			closeAux(ls)
+			return nil, err
+		}
+		c.aux.Listener = l
+		ls = append(ls, c.aux)
+	}
+	return ls, nil
+}
+
+func closeAux(ls []auxListener) {
+	for _, l := range ls {
+		l.Close()
+	}
+}
+
+// startAux starts serving on each listener in ls.
+func startAux(ls []auxListener) {
+	for _, l := range ls {
+		Logger.Info("serving "+l.name, "event", "listen", "addr", l.Addr().String())
+		go l.acceptLoop()
+	}
+}
+
+func (l auxListener) acceptLoop() {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			Logger.Error("error accepting", "event", l.name, "error", err)
+			continue
+		}
+
+		conn.SetDeadline(time.Now().Add(auxTimeout))
+		l.serve(conn)
+		conn.Close()
+	}
+}
+
+func (s *Server) writeMetrics(conn net.Conn) {
+	if _, err := s.Metrics.WriteTo(conn); err != nil {
+		Logger.Warn("error writing metrics", "event", "metrics", "remote_addr", conn.RemoteAddr().String(), "error", err)
+	}
+}
+
+// serveAdmin reads one command line from conn and writes the response.
+// The commands are:
+//
+//	metrics      the counters, as on the metrics listener
+//	conns        the active connections, one per line
+//	conns json   the active connections as a JSON array
+func (s *Server) serveAdmin(conn net.Conn) {
+	line, err := bufio.NewReader(io.LimitReader(conn, 256)).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+
+	switch cmd := strings.Join(strings.Fields(line), " "); cmd {
+	case "metrics":
+		_, err = s.Metrics.WriteTo(conn)
+	case "conns":
+		err = writeConnsText(conn, s.Conns(), time.Now())
+	case "conns json":
+		err = json.NewEncoder(conn).Encode(s.Conns())
+	default:
+		_, err = fmt.Fprintf(conn, "unknown command %q\n", cmd)
+	}
+	if err != nil {
+		Logger.Warn("error writing admin response", "event", "admin", "remote_addr", conn.RemoteAddr().String(), "error", err)
+	}
+}
+
+func writeConnsText(w io.Writer, conns []ConnInfo, now time.Time) error {
+	for _, c := range conns {
+		_, err := fmt.Fprintf(w, "id=%d remote_addr=%s connected_at=%s age=%s idle=%s bytes_read=%d bytes_written=%d\n",
+			c.ID, c.RemoteAddr, c.ConnectedAt.Format(time.RFC3339),
+			now.Sub(c.ConnectedAt).Round(time.Millisecond),
+			now.Sub(c.LastActivity).Round(time.Millisecond),
+			c.BytesRead, c.BytesWritten)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
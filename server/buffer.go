@@ -0,0 +1,32 @@
+package server
+
+import "sync"
+
+// bufferPools holds a *sync.Pool of *[]byte for each buffer size in use.
+var bufferPools sync.Map
+
+func bufferPool(size int) *sync.Pool {
+	if p, ok := bufferPools.Load(size); ok {
+		return p.(*sync.Pool)
+	}
+	p, _ := bufferPools.LoadOrStore(size, &sync.Pool{
+		New: func() any {
+			b := make([]byte, size)
+			return &b
+		},
+	})
+	return p.(*sync.Pool)
+}
+
+// getBuffer returns a pooled buffer of the given size, or of
+// DefaultReadBufferSize if size is not positive. Return it with putBuffer.
+func getBuffer(size int) *[]byte {
+	if size <= 0 {
+		size = DefaultReadBufferSize
+	}
+	return bufferPool(size).Get().(*[]byte)
+}
+
+func putBuffer(b *[]byte) {
+	bufferPool(len(*b)).Put(b)
+}
@@ -0,0 +1,508 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bufferedConn is a connection read through r, which may already hold
+// data received on it.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// NetConn returns the wrapped connection.
+func (c *bufferedConn) NetConn() net.Conn { return c.Conn }
+
+// ErrMaxLifetime is the close reason for connections open longer than
+// Server.MaxConnLifetime.
+var ErrMaxLifetime = errors.New("max lifetime exceeded")
+
+// ErrByteLimit is the close reason for connections that sent more than
+// Server.MaxConnBytes.
+var ErrByteLimit = errors.New("byte limit exceeded")
+
+// ErrWriteTimeout is the close reason for connections that did not
+// accept a write within Server.WriteTimeout.
+var ErrWriteTimeout = errors.New("write timeout")
+
+// ErrHandlerPanic is the close reason for connections whose handler
+// panicked.
+var ErrHandlerPanic = errors.New("handler panic")
+
+// ErrHandshakeTimeout is the close reason for connections that send
+// nothing within Server.HandshakeTimeout.
+var ErrHandshakeTimeout = errors.New("handshake timeout")
+
+// serverConn wraps an accepted connection to apply the server's idle
+// timeout and track its activity for the registry. It remembers the
+// first error seen on the connection so the disconnect can be logged
+// with its cause.
+//
+// Once ctx is cancelled, pending and future reads fail so that handlers
+// blocked in Read return promptly on shutdown.
+type serverConn struct {
+	net.Conn
+	s           *Server
+	ctx         context.Context
+	id          uint64
+	log         *slog.Logger
+	connectedAt time.Time
+
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+	lastActivity atomic.Int64 // UnixNano
+
+	// deadlineMu orders idle deadline refreshes against the deadline set
+	// on cancellation, so a refresh cannot undo it.
+	deadlineMu sync.Mutex
+
+	// The write queue, started by the first enqueue.
+	writerOnce sync.Once
+	out        chan []byte
+	quit       chan struct{}
+	writerDone chan struct{}
+
+	mu     sync.Mutex
+	err    error
+	reason error
+}
+
+func newServerConn(ctx context.Context, s *Server, conn net.Conn, id uint64, accepted time.Time, log *slog.Logger) (*serverConn, func() bool) {
+	c := &serverConn{
+		Conn:        conn,
+		s:           s,
+		ctx:         ctx,
+		id:          id,
+		log:         log,
+		connectedAt: accepted,
+		quit:        make(chan struct{}),
+	}
+	c.lastActivity.Store(time.Now().UnixNano())
+	stop := context.AfterFunc(ctx, func() {
+		c.deadlineMu.Lock()
+		defer c.deadlineMu.Unlock()
+		c.setCloseReason(ErrServerClosed)
+		c.Conn.SetReadDeadline(time.Now())
+	})
+	return c, stop
+}
+
+func (c *serverConn) Read(p []byte) (int, error) {
+	if max := c.s.MaxConnBytes; max > 0 && c.bytesRead.Load() > max {
+		return 0, ErrByteLimit
+	}
+
+	c.deadlineMu.Lock()
+	if c.ctx.Err() != nil {
+		c.deadlineMu.Unlock()
+		return 0, ErrServerClosed
+	}
+	// Until the client sends its first byte the handshake timeout, counted
+	// from accept, applies instead of the idle timeout.
+	handshake := c.s.HandshakeTimeout > 0 && c.bytesRead.Load() == 0
+	if handshake {
+		c.Conn.SetReadDeadline(c.connectedAt.Add(c.s.HandshakeTimeout))
+	} else if timeout := c.s.current().IdleTimeout; timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	} else if c.s.HandshakeTimeout > 0 {
+		c.Conn.SetReadDeadline(time.Time{})
+	}
+	c.deadlineMu.Unlock()
+
+	n, err := c.Conn.Read(p)
+	var ne net.Error
+	if handshake && n == 0 && errors.As(err, &ne) && ne.Timeout() {
+		c.setCloseReason(ErrHandshakeTimeout)
+	}
+	if n > 0 {
+		total := c.bytesRead.Add(int64(n))
+		c.s.Metrics.BytesRead.Add(int64(n))
+		c.lastActivity.Store(time.Now().UnixNano())
+
+		if max := c.s.MaxConnBytes; max > 0 && total > max {
+			// Pass on only the part of this read that is within the
+			// limit, then drop the client.
+			n -= int(min(total-max, int64(n)))
+			c.log.Warn("byte limit exceeded", "event", "limit", "remote_addr", c.RemoteAddr().String(), "limit", max)
+			c.setCloseReason(ErrByteLimit)
+			return n, ErrByteLimit
+		}
+	}
+	if err != nil {
+		c.setErr(err)
+	}
+	return n, err
+}
+
+func (c *serverConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.bytesWritten.Add(int64(n))
+		c.s.Metrics.BytesWritten.Add(int64(n))
+		c.lastActivity.Store(time.Now().UnixNano())
+	}
+	if err != nil {
+		c.setErr(err)
+	}
+	return n, err
+}
+
+// NetConn returns the wrapped connection. Handlers that need the
+// underlying socket, say to type-assert *net.TCPConn, should go through
+// it; the server's own socket options are applied before wrapping.
+func (c *serverConn) NetConn() net.Conn { return c.Conn }
+
+func (c *serverConn) setErr(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+}
+
+// closeErr returns the reason the connection ended: the one given to
+// setCloseReason if any, otherwise the first read or write error.
+func (c *serverConn) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reason != nil {
+		return c.reason
+	}
+	return c.err
+}
+
+func (c *serverConn) setCloseReason(err error) {
+	c.mu.Lock()
+	if c.reason == nil {
+		c.reason = err
+	}
+	c.mu.Unlock()
+}
+
+// ConnID returns the ID the server assigned to conn when it was accepted,
+// or 0 if conn was not accepted by a Server. IDs are unique per Server and
+// appear as "conn_id" in its log lines.
+func ConnID(conn net.Conn) uint64 {
+	if c, ok := conn.(*serverConn); ok {
+		return c.id
+	}
+	return 0
+}
+
+// connLogger returns the logger for conn, which includes its ID.
+func connLogger(conn net.Conn) *slog.Logger {
+	if c, ok := conn.(*serverConn); ok {
+		return c.log
+	}
+	return Logger
+}
+
+// setCloseReason records why a handler in this package gave up on conn,
+// for the disconnect log line.
+func setCloseReason(conn net.Conn, err error) {
+	if c, ok := conn.(*serverConn); ok {
+		c.setCloseReason(err)
+	}
+}
+
+// maxPrefaceTimeout caps how long serve waits for what a client must send
+// before the handler runs, such as the PROXY header, if HandshakeTimeout
+// is not set.
+const maxPrefaceTimeout = 10 * time.Second
+
+// guardPreface bounds the reads serve makes on conn before the handler
+// runs: they fail once the handshake timeout has passed since accept,
+// or when ctx is cancelled. The returned function lifts the bound and
+// reports false if ctx was cancelled in the meantime.
+func (s *Server) guardPreface(ctx context.Context, conn net.Conn, accepted time.Time) func() bool {
+	timeout := s.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = maxPrefaceTimeout
+		if idle := s.current().IdleTimeout; idle > 0 {
+			timeout = min(idle, timeout)
+		}
+	}
+	conn.SetReadDeadline(accepted.Add(timeout))
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+
+	return func() bool {
+		if !stop() {
+			return false
+		}
+		conn.SetReadDeadline(time.Time{})
+		return true
+	}
+}
+
+// prefaceErr returns the error to report for err, returned by a read
+// bounded by guardPreface: ErrHandshakeTimeout if the read timed out
+// and HandshakeTimeout is set.
+func (s *Server) prefaceErr(err error) error {
+	var ne net.Error
+	if s.HandshakeTimeout > 0 && errors.As(err, &ne) && ne.Timeout() {
+		return ErrHandshakeTimeout
+	}
+	return err
+}
+
+// serve serves conn, which was accepted at the time given, until it
+// disconnects.
+func (s *Server) serve(ctx context.Context, conn net.Conn, id uint64, accepted time.Time, log *slog.Logger) {
+	defer s.untrack(conn)
+	defer conn.Close()
+
+	s.configureConn(conn, log)
+
+	if s.ProxyProtocol {
+		lift := s.guardPreface(ctx, conn, accepted)
+		pc, err := acceptProxy(conn)
+		if !lift() {
+			return
+		}
+		if err != nil {
+			log.Warn("invalid proxy protocol header", "event", "proxy", "remote_addr", conn.RemoteAddr().String(), "error", s.prefaceErr(err))
+			return
+		}
+		if !s.admitClient(pc.RemoteAddr(), log) {
+			return
+		}
+		conn = pc
+		if s.TLSConfig != nil {
+			conn = tls.Server(pc, s.TLSConfig)
+		}
+	}
+
+	if s.DetectHTTP {
+		lift := s.guardPreface(ctx, conn, accepted)
+		probed, err := s.probeHTTP(conn, log)
+		if !lift() {
+			return
+		}
+		if err != nil {
+			log.Info("client disconnected", "event", "disconnect", "remote_addr", conn.RemoteAddr().String(), "reason", disconnectReason(s.prefaceErr(err)))
+			return
+		}
+		if probed == nil {
+			return
+		}
+		conn = probed
+	}
+
+	c, stop := newServerConn(ctx, s, conn, id, accepted, log)
+	defer stop()
+	s.register(c)
+	defer s.unregister(c)
+
+	remoteaddr := c.RemoteAddr().String()
+	log.Info("real client connected", "event", "connect", "remote_addr", remoteaddr)
+
+	if s.OnConnect != nil {
+		s.OnConnect(c)
+	}
+	if s.OnDisconnect != nil {
+		defer func() { s.OnDisconnect(c, c.closeErr()) }()
+	}
+
+	if s.MaxConnLifetime > 0 {
+		timer := time.AfterFunc(s.MaxConnLifetime, func() {
+			c.setCloseReason(ErrMaxLifetime)
+			c.Conn.Close()
+		})
+		defer timer.Stop()
+	}
+
+	if s.MinRate > 0 {
+		defer s.watchRate(c)()
+	}
+
+	if s.Banner != "" {
+		if err := s.writeBanner(c); err != nil {
+			log.Warn("error writing banner", "event", "banner", "remote_addr", remoteaddr, "error", err)
+			return
+		}
+	}
+
+	s.handle(ctx, c)
+	c.stopWriter()
+
+	log.Info("client disconnected",
+		"event", "disconnect",
+		"remote_addr", remoteaddr,
+		"duration", time.Since(accepted).Round(time.Millisecond).String(),
+		"bytes", c.bytesRead.Load(),
+		"bytes_written", c.bytesWritten.Load(),
+		"reason", disconnectReason(c.closeErr()))
+}
+
+// handle runs the handler for c. A panic in the handler is logged and
+// ends the connection rather than the process.
+func (s *Server) handle(ctx context.Context, c *serverConn) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.Metrics.Panics.Add(1)
+			c.setCloseReason(ErrHandlerPanic)
+			c.log.Error("handler panicked", "event", "panic", "remote_addr", c.RemoteAddr().String(), "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+		}
+	}()
+	s.handler().Handle(ctx, c)
+}
+
+// writeBanner sends s.Banner, terminated by "\r\n", to conn.
+func (s *Server) writeBanner(conn net.Conn) error {
+	banner := s.Banner
+	if !strings.HasSuffix(banner, "\r\n") {
+		banner = strings.TrimSuffix(banner, "\n") + "\r\n"
+	}
+	return writeAll(conn, []byte(banner), s.WriteTimeout)
+}
+
+// lineHandler passes each newline-terminated line the client sends to fn
+// until the client disconnects or sends a line longer than max.
+type lineHandler struct {
+	fn  func(conn net.Conn, line []byte)
+	max int
+}
+
+func (h lineHandler) Handle(ctx context.Context, conn net.Conn) {
+	scanLines(conn, h.max, func(line []byte) bool {
+		h.fn(conn, line)
+		return true
+	})
+}
+
+// scanLines calls fn with each newline-terminated line read from conn,
+// until fn returns false, the client disconnects or it sends a line
+// longer than max. Zero max means DefaultMaxLineLength.
+func scanLines(conn net.Conn, max int, fn func(line []byte) bool) {
+	if max <= 0 {
+		max = DefaultMaxLineLength
+	}
+
+	scanner := bufio.NewScanner(conn)
+	// Leave room for the trailing "\r\n" so a line of exactly max bytes
+	// fits. That also fits max+1 bytes ending in a bare "\n", so the
+	// length is checked again once the terminator is stripped.
+	scanner.Buffer(make([]byte, 0, min(max+2, 4096)), max+2)
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) > max {
+			lineTooLong(conn, max)
+			return
+		}
+		if answerPing(conn, line) {
+			continue
+		}
+		if !fn(line) {
+			return
+		}
+	}
+	if err := scanner.Err(); errors.Is(err, bufio.ErrTooLong) {
+		lineTooLong(conn, max)
+	}
+}
+
+// lineTooLong logs that conn sent a line longer than max and records
+// bufio.ErrTooLong as the close reason.
+func lineTooLong(conn net.Conn, max int) {
+	connLogger(conn).Error("line too long", "event", "line", "remote_addr", conn.RemoteAddr().String(), "max", max)
+	setCloseReason(conn, bufio.ErrTooLong)
+}
+
+// answerPing replies "PONG" and reports true if line is a PING command
+// and the server has PingPong set.
+func answerPing(conn net.Conn, line []byte) bool {
+	c, ok := conn.(*serverConn)
+	if !ok || !c.s.PingPong || !bytes.EqualFold(line, []byte("PING")) {
+		return false
+	}
+	c.s.Metrics.Pings.Add(1)
+	Enqueue(conn, []byte("PONG\n"))
+	return true
+}
+
+// disconnectReason describes why a connection ended with err.
+func disconnectReason(err error) string {
+	var ne net.Error
+	switch {
+	case err == nil:
+		return "closed"
+	case errors.Is(err, ErrServerClosed):
+		return "server shutdown"
+	case errors.Is(err, ErrMaxLifetime):
+		return "max lifetime exceeded"
+	case errors.Is(err, ErrHandshakeTimeout):
+		return "handshake timeout"
+	case errors.Is(err, ErrHandlerPanic):
+		return "handler panic"
+	case errors.Is(err, ErrWriteTimeout):
+		return "write timeout"
+	case errors.Is(err, ErrByteLimit):
+		return "byte limit exceeded"
+	case errors.Is(err, ErrTooSlow):
+		return "too slow"
+	case errors.Is(err, ErrQueueFull):
+		return "write queue full"
+	case errors.Is(err, io.EOF):
+		return "eof"
+	case errors.As(err, &ne) && ne.Timeout():
+		return "idle timeout"
+	case errors.Is(err, bufio.ErrTooLong):
+		return "line too long"
+	case errors.Is(err, ErrFrameTooLarge):
+		return "frame too large"
+	case errors.Is(err, ErrBadJSON):
+		return "malformed json"
+	default:
+		return "error: " + err.Error()
+	}
+}
+
+// writeAll writes all of data to conn, retrying after short writes. If
+// timeout is positive the whole write must finish within it; a client
+// that does not accept the data in time is disconnected.
+func writeAll(conn net.Conn, data []byte, timeout time.Duration) error {
+	if timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	for len(data) > 0 {
+		n, err := conn.Write(data)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				setCloseReason(conn, ErrWriteTimeout)
+				conn.Close()
+			}
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// writeTimeout returns the write timeout that applies to conn.
+func writeTimeout(conn net.Conn) time.Duration {
+	if c, ok := conn.(*serverConn); ok {
+		return c.s.WriteTimeout
+	}
+	return 0
+}
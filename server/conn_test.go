@@ -0,0 +1,286 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLineHandlerSplitsLines(t *testing.T) {
+	lines := make(chan string, 10)
+	s := startServer(t, func(s *Server) {
+		s.LineHandler = func(conn net.Conn, line []byte) {
+			lines <- string(line)
+		}
+	})
+
+	conn := dial(t, s)
+	// Both lines in a single write, and so normally a single segment.
+	if _, err := conn.Write([]byte("first\r\nsecond\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	var got []string
+	for range 2 {
+		select {
+		case line := <-lines:
+			got = append(got, line)
+		case <-time.After(time.Second):
+			t.Fatalf("got lines %q, want 2", got)
+		}
+	}
+	if want := []string{"first", "second"}; !slices.Equal(got, want) {
+		t.Errorf("got lines %q, want %q", got, want)
+	}
+}
+
+func TestLineHandlerTooLong(t *testing.T) {
+	const max = 8
+	tests := []struct {
+		input string
+		ok    bool
+	}{
+		{"12345678\n", true},
+		{"12345678\r\n", true},
+		{"123456789\n", false},
+		{"123456789\r\n", false},
+		{"0123456789abcdef\n", false},
+	}
+	for _, tt := range tests {
+		lines := make(chan string, 1)
+		reasons := make(chan error, 1)
+		s := startServer(t, func(s *Server) {
+			s.LineHandler = func(conn net.Conn, line []byte) { lines <- string(line) }
+			s.MaxLineLength = max
+			s.OnDisconnect = func(conn net.Conn, err error) { reasons <- err }
+		})
+
+		conn := dial(t, s)
+		if _, err := conn.Write([]byte(tt.input)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if tt.ok {
+			select {
+			case line := <-lines:
+				if want := tt.input[:max]; line != want {
+					t.Errorf("%q: got line %q, want %q", tt.input, line, want)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("%q: line of %d bytes not delivered", tt.input, max)
+			}
+			continue
+		}
+
+		select {
+		case err := <-reasons:
+			if !errors.Is(err, bufio.ErrTooLong) {
+				t.Errorf("%q: close reason = %v, want %v", tt.input, err, bufio.ErrTooLong)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%q: connection not closed", tt.input)
+		}
+		select {
+		case line := <-lines:
+			t.Errorf("%q: line %q over the limit delivered", tt.input, line)
+		default:
+		}
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	tests := []struct {
+		name  string
+		setup func(s *Server)
+		// sent is written to the connection after a delay, then nothing.
+		sent string
+	}{
+		{name: "plain"},
+		{name: "detect http", setup: func(s *Server) { s.DetectHTTP = true }},
+		{name: "proxy protocol", setup: func(s *Server) { s.ProxyProtocol = true }},
+		{
+			name:  "proxy header only",
+			setup: func(s *Server) { s.ProxyProtocol = true },
+			sent:  "PROXY TCP4 198.51.100.7 198.51.100.1 56324 443\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startServer(t, func(s *Server) {
+				s.Echo = true
+				s.HandshakeTimeout = timeout
+				if tt.setup != nil {
+					tt.setup(s)
+				}
+			})
+
+			start := time.Now()
+			conn := dial(t, s)
+			if tt.sent != "" {
+				// The window counts from accept, so time spent
+				// before the handler does not extend it.
+				time.Sleep(timeout * 3 / 4)
+				conn.Write([]byte(tt.sent))
+			}
+
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err := conn.Read(make([]byte, 1))
+			if err == nil || isTimeout(err) {
+				t.Fatalf("Read returned %v, want the connection closed", err)
+			}
+			if d := time.Since(start); d < timeout || d > timeout*3/2 {
+				t.Errorf("connection closed after %v, want about %v", d, timeout)
+			}
+		})
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	reasons := make(chan error, 2)
+	s := startServer(t, func(s *Server) {
+		// Echo each byte back, except 'p', which panics.
+		s.Handler = HandlerFunc(func(ctx context.Context, conn net.Conn) {
+			var buf [1]byte
+			for {
+				if _, err := conn.Read(buf[:]); err != nil {
+					return
+				}
+				if buf[0] == 'p' {
+					panic("boom")
+				}
+				conn.Write(buf[:])
+			}
+		})
+		s.OnDisconnect = func(conn net.Conn, err error) { reasons <- err }
+	})
+
+	conn := dial(t, s)
+	conn.Write([]byte("p"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("Read after the panic returned %v, want the connection closed", err)
+	}
+	select {
+	case err := <-reasons:
+		if !errors.Is(err, ErrHandlerPanic) {
+			t.Errorf("close reason = %v, want %v", err, ErrHandlerPanic)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnDisconnect not called after the panic")
+	}
+	if n := s.Metrics.Panics.Load(); n != 1 {
+		t.Errorf("Metrics.Panics = %d, want 1", n)
+	}
+
+	if !echoes(t, dial(t, s), time.Second) {
+		t.Error("server not serving new connections after a handler panic")
+	}
+}
+
+// shortWriteConn accepts at most one byte per Write, and fails with
+// os.ErrDeadlineExceeded once limit bytes have been written.
+type shortWriteConn struct {
+	net.Conn
+	buf       bytes.Buffer
+	limit     int
+	deadlines []time.Time
+	closed    bool
+}
+
+func (c *shortWriteConn) Write(p []byte) (int, error) {
+	if c.limit > 0 && c.buf.Len() >= c.limit {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return c.buf.Write(p[:1])
+}
+
+func (c *shortWriteConn) SetWriteDeadline(t time.Time) error {
+	c.deadlines = append(c.deadlines, t)
+	return nil
+}
+
+func (c *shortWriteConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestWriteAllShortWrites(t *testing.T) {
+	conn := &shortWriteConn{}
+	if err := writeAll(conn, []byte("hello, world"), time.Second); err != nil {
+		t.Fatalf("writeAll: %v", err)
+	}
+	if got := conn.buf.String(); got != "hello, world" {
+		t.Errorf("wrote %q, want %q", got, "hello, world")
+	}
+	if len(conn.deadlines) != 2 || conn.deadlines[0].IsZero() || !conn.deadlines[1].IsZero() {
+		t.Errorf("write deadlines = %v, want one set and then cleared", conn.deadlines)
+	}
+	if conn.closed {
+		t.Error("connection closed after a successful write")
+	}
+}
+
+func TestWriteAllTimeout(t *testing.T) {
+	conn := &shortWriteConn{limit: 3}
+	err := writeAll(conn, []byte("hello"), time.Second)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("writeAll returned %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if got := conn.buf.String(); got != "hel" {
+		t.Errorf("wrote %q before the timeout, want %q", got, "hel")
+	}
+	if !conn.closed {
+		t.Error("connection not closed after the write timed out")
+	}
+}
+
+func TestMaxConnBytes(t *testing.T) {
+	type result struct {
+		data []byte
+		err  error
+	}
+	read := make(chan result, 1)
+	s := startServer(t, func(s *Server) {
+		s.MaxConnBytes = 10
+		s.Handler = HandlerFunc(func(ctx context.Context, conn net.Conn) {
+			// Small reads, so the limit is crossed in the middle of one.
+			var data []byte
+			buf := make([]byte, 4)
+			for {
+				n, err := conn.Read(buf)
+				data = append(data, buf[:n]...)
+				if err != nil {
+					read <- result{data, err}
+					return
+				}
+			}
+		})
+	})
+
+	conn := dial(t, s)
+	if _, err := conn.Write([]byte("0123456789abcdef")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	select {
+	case r := <-read:
+		if string(r.data) != "0123456789" {
+			t.Errorf("handler read %q, want %q", r.data, "0123456789")
+		}
+		if !errors.Is(r.err, ErrByteLimit) {
+			t.Errorf("handler read error = %v, want %v", r.err, ErrByteLimit)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler still reading past the limit")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("Read returned %v, want the connection closed", err)
+	}
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+)
+
+// remoteIP returns the IP address of addr, if it has one.
+func remoteIP(addr net.Addr) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap(), true
+}
+
+// allowed reports whether a client at addr may connect according to the
+// AllowCIDRs and DenyCIDRs settings. Deny takes precedence over allow.
+// When an allow list is set, addresses without an IP (such as Unix
+// sockets) are refused.
+func (s *Server) allowed(addr net.Addr) bool {
+	st := s.current()
+	if len(st.AllowCIDRs) == 0 && len(st.DenyCIDRs) == 0 {
+		return true
+	}
+
+	ip, ok := remoteIP(addr)
+	if !ok {
+		return len(st.AllowCIDRs) == 0
+	}
+	if containsIP(st.DenyCIDRs, ip) {
+		return false
+	}
+	return len(st.AllowCIDRs) == 0 || containsIP(st.AllowCIDRs, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip netip.Addr) bool {
+	for _, n := range nets {
+		if n.Contains(ip.AsSlice()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+)
+
+// DefaultMaxFrameSize is the largest frame payload ReadFrame accepts, and
+// the limit used when Server.MaxFrameSize is zero.
+const DefaultMaxFrameSize = 16 << 20
+
+// ErrFrameTooLarge is returned when a frame header announces a payload
+// larger than the configured limit.
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// ReadFrame reads one length-prefixed frame from conn: a 4-byte
+// big-endian payload length followed by the payload itself.
+func ReadFrame(conn net.Conn) ([]byte, error) {
+	return readFrame(conn, DefaultMaxFrameSize)
+}
+
+func readFrame(r io.Reader, max int) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if uint64(size) > uint64(max) {
+		return nil, fmt.Errorf("%w: %d bytes, limit %d", ErrFrameTooLarge, size, max)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return payload, nil
+}
+
+// WriteFrame writes payload to conn as a single length-prefixed frame.
+func WriteFrame(conn net.Conn, payload []byte) error {
+	if uint64(len(payload)) > math.MaxUint32 {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, len(payload))
+	}
+
+	buf := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	copy(buf[4:], payload)
+	return writeAll(conn, buf, writeTimeout(conn))
+}
+
+// frameHandler passes each frame the client sends to fn until the
+// client disconnects or sends a frame larger than max.
+type frameHandler struct {
+	fn  func(conn net.Conn, payload []byte)
+	max int
+}
+
+func (h frameHandler) Handle(ctx context.Context, conn net.Conn) {
+	max := h.max
+	if max <= 0 {
+		max = DefaultMaxFrameSize
+	}
+
+	for {
+		payload, err := readFrame(conn, max)
+		if err != nil {
+			if errors.Is(err, ErrFrameTooLarge) {
+				setCloseReason(conn, err)
+			}
+			return
+		}
+
+		h.fn(conn, payload)
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestReadFrameSplitWrites(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	payload := []byte("hello, frame")
+	go func() {
+		// The header and payload, each split across writes.
+		client.Write([]byte{0, 0})
+		client.Write([]byte{0, byte(len(payload))})
+		client.Write(payload[:5])
+		client.Write(payload[5:])
+	}()
+
+	got, err := ReadFrame(server)
+	if err != nil {
+		t.Fatalf("ReadFrame: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("ReadFrame = %q, want %q", got, payload)
+	}
+}
+
+func TestReadFrameTooLarge(t *testing.T) {
+	r := bytes.NewReader([]byte{0, 0, 1, 0})
+	if _, err := readFrame(r, 255); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("readFrame = %v, want ErrFrameTooLarge", err)
+	}
+}
+
+func TestWriteFrameRoundTrip(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	payload := []byte("round trip")
+	go WriteFrame(client, payload)
+
+	got, err := ReadFrame(server)
+	if err != nil {
+		t.Fatalf("ReadFrame: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("ReadFrame = %q, want %q", got, payload)
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"slices"
+	"time"
+)
+
+// Handler serves a single client connection. The connection is closed
+// when Handle returns. ctx is cancelled when the server is stopped.
+type Handler interface {
+	Handle(ctx context.Context, conn net.Conn)
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface.
+type HandlerFunc func(ctx context.Context, conn net.Conn)
+
+// Handle calls f(ctx, conn).
+func (f HandlerFunc) Handle(ctx context.Context, conn net.Conn) {
+	f(ctx, conn)
+}
+
+// DiscardHandler reads and discards everything the client sends until
+// the connection fails.
+type DiscardHandler struct {
+	// BufferSize is the size of the read buffer. Zero means
+	// DefaultReadBufferSize.
+	BufferSize int
+}
+
+// Handle implements Handler.
+func (h DiscardHandler) Handle(ctx context.Context, conn net.Conn) {
+	bufp := getBuffer(h.BufferSize)
+	defer putBuffer(bufp)
+
+	for {
+		if _, err := conn.Read(*bufp); err != nil {
+			return
+		}
+	}
+}
+
+// EchoHandler writes everything the client sends back to it until the
+// connection fails. Writes go through Enqueue, so a client that sends
+// faster than it reads is disconnected.
+type EchoHandler struct {
+	// BufferSize is the size of the read buffer. Zero means
+	// DefaultReadBufferSize.
+	BufferSize int
+}
+
+// Handle implements Handler.
+func (h EchoHandler) Handle(ctx context.Context, conn net.Conn) {
+	bufp := getBuffer(h.BufferSize)
+	defer putBuffer(bufp)
+	buffer := *bufp
+
+	for {
+		n, err := conn.Read(buffer)
+		if n > 0 {
+			if err := Enqueue(conn, slices.Clone(buffer[:n])); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// FastEchoHandler echoes like EchoHandler, but on plain TCP connections
+// it copies the socket to itself with io.Copy so the runtime can move
+// the data in the kernel (splice on Linux) instead of through a buffer.
+// Byte counters are only updated once the copy ends.
+// The copy bypasses the server's per-connection limits, so when any of
+// IdleTimeout, HandshakeTimeout, MaxConnBytes, MinRate, WriteTimeout or
+// WriteQueueDepth is set it falls back to EchoHandler, as it does for
+// other connections, such as TLS or PROXY protocol ones.
+type FastEchoHandler struct {
+	// BufferSize is passed to EchoHandler when falling back.
+	BufferSize int
+}
+
+// Handle implements Handler.
+func (h FastEchoHandler) Handle(ctx context.Context, conn net.Conn) {
+	c, ok := conn.(*serverConn)
+	if !ok {
+		EchoHandler{BufferSize: h.BufferSize}.Handle(ctx, conn)
+		return
+	}
+	tcp, ok := c.Conn.(*net.TCPConn)
+	if !ok || c.s.limitsConns() {
+		EchoHandler{BufferSize: h.BufferSize}.Handle(ctx, conn)
+		return
+	}
+
+	n, err := io.Copy(tcp, tcp)
+	c.bytesRead.Add(n)
+	c.bytesWritten.Add(n)
+	c.s.Metrics.BytesRead.Add(n)
+	c.s.Metrics.BytesWritten.Add(n)
+	c.lastActivity.Store(time.Now().UnixNano())
+	if err != nil {
+		c.setErr(err)
+	} else {
+		c.setErr(io.EOF)
+	}
+}
+
+// limitsConns reports whether s applies a limit that needs every read
+// and write to go through serverConn.
+func (s *Server) limitsConns() bool {
+	return s.current().IdleTimeout > 0 ||
+		s.HandshakeTimeout > 0 ||
+		s.MaxConnBytes > 0 ||
+		s.MinRate > 0 ||
+		s.WriteTimeout > 0 ||
+		s.WriteQueueDepth > 0
+}
+
+// handler returns the Handler for new connections, built from the
+// server's settings if s.Handler is nil.
+func (s *Server) handler() Handler {
+	switch {
+	case s.Handler != nil:
+		return s.Handler
+	case s.FrameHandler != nil:
+		return frameHandler{fn: s.FrameHandler, max: s.MaxFrameSize}
+	case s.JSONHandlers != nil:
+		return jsonHandler{handlers: s.JSONHandlers, strict: s.StrictJSON, max: s.MaxLineLength}
+	case s.LineHandler != nil:
+		return lineHandler{fn: s.LineHandler, max: s.MaxLineLength}
+	case s.Echo && s.FastEcho:
+		return FastEchoHandler{BufferSize: s.ReadBufferSize}
+	case s.Echo:
+		return EchoHandler{BufferSize: s.ReadBufferSize}
+	default:
+		return DiscardHandler{BufferSize: s.ReadBufferSize}
+	}
+}
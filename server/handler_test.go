@@ -0,0 +1,65 @@
+package server
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func BenchmarkEcho(b *testing.B) {
+	for _, bm := range []struct {
+		name    string
+		handler Handler
+	}{
+		{"EchoHandler", EchoHandler{}},
+		{"FastEchoHandler", FastEchoHandler{}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			conn := dial(b, startServer(b, func(s *Server) { s.Handler = bm.handler }))
+			msg := make([]byte, 32<<10)
+			buf := make([]byte, len(msg))
+			b.SetBytes(int64(len(msg)))
+			for b.Loop() {
+				if _, err := conn.Write(msg); err != nil {
+					b.Fatalf("Write: %v", err)
+				}
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					b.Fatalf("reading echo: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestFastEchoLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(s *Server)
+		// sent is written before the client goes quiet.
+		sent string
+	}{
+		{"idle timeout", func(s *Server) { s.IdleTimeout = 100 * time.Millisecond }, "x"},
+		{"handshake timeout", func(s *Server) { s.HandshakeTimeout = 100 * time.Millisecond }, ""},
+		{"max conn bytes", func(s *Server) { s.MaxConnBytes = 4 }, "0123456789"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startServer(t, func(s *Server) {
+				s.Echo = true
+				s.FastEcho = true
+				tt.setup(s)
+			})
+
+			conn := dial(t, s)
+			conn.Write([]byte(tt.sent))
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			got, err := io.ReadAll(conn)
+			if isTimeout(err) {
+				t.Fatal("connection still open, the limit was not applied")
+			}
+			if max := s.MaxConnBytes; max > 0 && int64(len(got)) > max {
+				t.Errorf("echoed %q past MaxConnBytes %d", got, max)
+			}
+		})
+	}
+}
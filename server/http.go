@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"log/slog"
+	"net"
+)
+
+// httpMethods are the request line prefixes that identify an HTTP client.
+var httpMethods = [][]byte{
+	[]byte("GET "),
+	[]byte("HEAD "),
+	[]byte("POST "),
+	[]byte("PUT "),
+	[]byte("DELETE "),
+	[]byte("OPTIONS "),
+	[]byte("PATCH "),
+	[]byte("CONNECT "),
+	[]byte("TRACE "),
+}
+
+// maxHTTPPeek is the most bytes peeked to detect HTTP, the length of the
+// longest entry in httpMethods.
+const maxHTTPPeek = len("OPTIONS ")
+
+// httpProbeResponse answers HTTP health checks.
+const httpProbeResponse = "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+
+// detectHTTP reports whether prefix, the first bytes received on a
+// connection, starts an HTTP request. If prefix is too short to tell,
+// more is true.
+func detectHTTP(prefix []byte) (isHTTP, more bool) {
+	for _, m := range httpMethods {
+		switch {
+		case bytes.HasPrefix(prefix, m):
+			return true, false
+		case bytes.HasPrefix(m, prefix):
+			more = true
+		}
+	}
+	return false, more
+}
+
+// peekHTTP reports whether the data waiting in r starts an HTTP request,
+// without consuming it. It reads only as much as needed to decide, so a
+// client that sends a short non-HTTP message is not kept waiting.
+func peekHTTP(r *bufio.Reader) (bool, error) {
+	for n := 1; n <= maxHTTPPeek; n++ {
+		prefix, err := r.Peek(n)
+		if err != nil {
+			return false, err
+		}
+		isHTTP, more := detectHTTP(prefix)
+		if !more {
+			return isHTTP, nil
+		}
+	}
+	return false, nil
+}
+
+// probeHTTP answers conn and returns a nil net.Conn if it starts with an
+// HTTP request. Otherwise it returns a connection that reads from the
+// start, including the peeked bytes, or the error that ended the peek.
+// The caller bounds the peek with guardPreface.
+func (s *Server) probeHTTP(conn net.Conn, log *slog.Logger) (net.Conn, error) {
+	var r *bufio.Reader
+	if pc, ok := conn.(*proxyConn); ok {
+		r = pc.r
+	} else {
+		bc := &bufferedConn{Conn: conn, r: bufio.NewReaderSize(conn, 512)}
+		conn, r = bc, bc.r
+	}
+
+	remote := conn.RemoteAddr().String()
+	isHTTP, err := peekHTTP(r)
+	if err != nil {
+		return nil, err
+	}
+	if !isHTTP {
+		return conn, nil
+	}
+
+	if err := writeAll(conn, []byte(httpProbeResponse), auxTimeout); err != nil {
+		log.Warn("error answering http probe", "event", "http", "remote_addr", remote, "error", err)
+		return nil, nil
+	}
+	log.Info("answered http probe", "event", "http", "remote_addr", remote)
+	return nil, nil
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDetectHTTP(t *testing.T) {
+	tests := []struct {
+		prefix       string
+		isHTTP, more bool
+	}{
+		{"GET ", true, false},
+		{"GET /health HTTP/1.1", true, false},
+		{"OPTIONS ", true, false},
+		{"G", false, true},
+		{"OPT", false, true},
+		{"GET", false, true},
+		{"GETX", false, false},
+		{"hello", false, false},
+		{"get ", false, false},
+	}
+	for _, tt := range tests {
+		isHTTP, more := detectHTTP([]byte(tt.prefix))
+		if isHTTP != tt.isHTTP || more != tt.more {
+			t.Errorf("detectHTTP(%q) = %v, %v, want %v, %v", tt.prefix, isHTTP, more, tt.isHTTP, tt.more)
+		}
+	}
+}
+
+func TestPeekHTTP(t *testing.T) {
+	tests := []struct {
+		input  string
+		isHTTP bool
+	}{
+		{"GET / HTTP/1.1\r\n\r\n", true},
+		{"DELETE /x HTTP/1.1\r\n\r\n", true},
+		{"hello\n", false},
+		{"GETTING\n", false},
+	}
+	for _, tt := range tests {
+		r := bufio.NewReader(strings.NewReader(tt.input))
+		isHTTP, err := peekHTTP(r)
+		if err != nil || isHTTP != tt.isHTTP {
+			t.Errorf("peekHTTP(%q) = %v, %v, want %v, nil", tt.input, isHTTP, err, tt.isHTTP)
+			continue
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != tt.input {
+			t.Errorf("peekHTTP(%q) consumed input, %q left", tt.input, rest)
+		}
+	}
+}
+
+func TestPeekHTTPShortMessage(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	// The client sends a message shorter than maxHTTPPeek and waits for
+	// an answer, so peekHTTP must decide without reading more.
+	go client.Write([]byte("hi"))
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	isHTTP, err := peekHTTP(bufio.NewReader(server))
+	if err != nil || isHTTP {
+		t.Errorf("peekHTTP = %v, %v, want false, nil", isHTTP, err)
+	}
+}
+
+func TestDetectHTTPProbe(t *testing.T) {
+	s := startServer(t, func(s *Server) {
+		s.Echo = true
+		s.DetectHTTP = true
+	})
+
+	probe := dial(t, s)
+	probe.Write([]byte("GET /health HTTP/1.1\r\nHost: x\r\n\r\n"))
+	probe.SetReadDeadline(time.Now().Add(time.Second))
+	resp, err := io.ReadAll(probe)
+	if err != nil {
+		t.Fatalf("reading probe response: %v", err)
+	}
+	if string(resp) != httpProbeResponse {
+		t.Errorf("probe response = %q, want %q", resp, httpProbeResponse)
+	}
+
+	if !echoes(t, dial(t, s), time.Second) {
+		t.Error("non-HTTP client not served")
+	}
+}
+
+func TestDetectHTTPSilentClientStop(t *testing.T) {
+	s := NewServer("127.0.0.1:0")
+	s.DetectHTTP = true
+	go s.Start()
+	<-s.Ready()
+
+	conn := dial(t, s)
+	waitFor(t, "the connection to be accepted", func() bool { return s.Metrics.Active.Load() == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Stop(ctx); err != nil {
+		t.Fatalf("Stop with a client yet to send anything: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("Read returned %v, want the connection closed", err)
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// Hub is a chat room: it broadcasts every line a client sends to all the
+// other connected clients. A Hub is a Handler, so it can be used as
+// Server.Handler directly.
+type Hub struct {
+	// MaxLineLength is the longest line accepted from a client. Zero
+	// means DefaultMaxLineLength.
+	MaxLineLength int
+
+	mu      sync.Mutex
+	clients map[net.Conn]struct{}
+}
+
+// NewHub returns an empty Hub.
+func NewHub() *Hub {
+	return &Hub{clients: make(map[net.Conn]struct{})}
+}
+
+// Register adds conn to the clients that receive broadcasts.
+func (h *Hub) Register(conn net.Conn) {
+	h.mu.Lock()
+	h.clients[conn] = struct{}{}
+	h.mu.Unlock()
+}
+
+// Unregister removes conn from the clients that receive broadcasts.
+func (h *Hub) Unregister(conn net.Conn) {
+	h.mu.Lock()
+	delete(h.clients, conn)
+	h.mu.Unlock()
+}
+
+// Broadcast queues msg for every registered client with Enqueue. A client
+// whose queue is full is unregistered and closed; the others still
+// receive msg.
+func (h *Hub) Broadcast(msg []byte) {
+	h.broadcast(nil, msg)
+}
+
+// broadcast writes msg to every registered client except from.
+func (h *Hub) broadcast(from net.Conn, msg []byte) {
+	h.mu.Lock()
+	clients := make([]net.Conn, 0, len(h.clients))
+	for conn := range h.clients {
+		if conn != from {
+			clients = append(clients, conn)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, conn := range clients {
+		if err := Enqueue(conn, msg); err != nil {
+			connLogger(conn).Warn("error broadcasting", "event", "broadcast", "remote_addr", conn.RemoteAddr().String(), "error", err)
+			h.Unregister(conn)
+			conn.Close()
+		}
+	}
+}
+
+// Handle implements Handler. It registers conn for the duration of the
+// connection and broadcasts each line it sends, newline included, to the
+// other clients.
+func (h *Hub) Handle(ctx context.Context, conn net.Conn) {
+	h.Register(conn)
+	defer h.Unregister(conn)
+
+	lines := lineHandler{
+		fn: func(conn net.Conn, line []byte) {
+			msg := make([]byte, len(line)+1)
+			copy(msg, line)
+			msg[len(line)] = '\n'
+			h.broadcast(conn, msg)
+		},
+		max: h.MaxLineLength,
+	}
+	lines.Handle(ctx, conn)
+}
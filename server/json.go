@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrBadJSON is the close reason for clients that send a malformed JSON
+// message in strict mode.
+var ErrBadJSON = errors.New("malformed json")
+
+// jsonHandler decodes each newline-terminated line the client sends as a
+// JSON object and passes it to the function registered for its "type"
+// field. Lines are split before decoding, rather than streaming the
+// connection through a json.Decoder, so a malformed message is confined
+// to its own line and the next one is read from a clean start.
+type jsonHandler struct {
+	handlers map[string]func(conn net.Conn, msg json.RawMessage)
+	strict   bool
+	max      int
+}
+
+func (h jsonHandler) Handle(ctx context.Context, conn net.Conn) {
+	scanLines(conn, h.max, func(line []byte) bool {
+		if len(line) == 0 {
+			return true
+		}
+
+		var msg struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(line, &msg); err != nil || msg.Type == "" {
+			writeJSONError(conn, "malformed message")
+			if h.strict {
+				setCloseReason(conn, ErrBadJSON)
+				return false
+			}
+			return true
+		}
+
+		fn, ok := h.handlers[msg.Type]
+		if !ok {
+			writeJSONError(conn, fmt.Sprintf("unknown type %q", msg.Type))
+			return true
+		}
+		fn(conn, json.RawMessage(line))
+		return true
+	})
+}
+
+// writeJSONError queues an error message for conn, such as
+// {"type":"error","error":"malformed message"}.
+func writeJSONError(conn net.Conn, text string) {
+	b, err := json.Marshal(struct {
+		Type  string `json:"type"`
+		Error string `json:"error"`
+	}{"error", text})
+	if err != nil {
+		return
+	}
+	Enqueue(conn, append(b, '\n'))
+}
@@ -0,0 +1,10 @@
+package server
+
+import (
+	"log/slog"
+	"os"
+)
+
+// Logger receives all log output from the server package. Replace it
+// before calling Start to change the format or level.
+var Logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Metrics holds counters describing server activity. The counters are
+// updated atomically and may be read while the server is running.
+// Draining is set once Server.Drain has been called.
+type Metrics struct {
+	Accepted     atomic.Int64
+	Active       atomic.Int64
+	BytesRead    atomic.Int64
+	BytesWritten atomic.Int64
+	AcceptErrors atomic.Int64
+	Pings        atomic.Int64
+	Panics       atomic.Int64
+	Draining     atomic.Bool
+}
+
+// WriteTo writes the counters to w as "name value" lines.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	n, err := fmt.Fprintf(w,
+		"connections_accepted %d\n"+
+			"connections_active %d\n"+
+			"bytes_read %d\n"+
+			"bytes_written %d\n"+
+			"accept_errors %d\n"+
+			"pings %d\n"+
+			"panics_recovered %d\n"+
+			"draining %d\n",
+		m.Accepted.Load(),
+		m.Active.Load(),
+		m.BytesRead.Load(),
+		m.BytesWritten.Load(),
+		m.AcceptErrors.Load(),
+		m.Pings.Load(),
+		m.Panics.Load(),
+		boolInt(m.Draining.Load()))
+	return int64(n), err
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"errors"
+	"time"
+)
+
+// Defaults for the minimum data rate check.
+const (
+	DefaultMinRateWindow   = 10 * time.Second
+	DefaultMinRateInterval = time.Second
+)
+
+// ErrTooSlow is the close reason for connections that send below
+// Server.MinRate.
+var ErrTooSlow = errors.New("too slow")
+
+// watchRate samples how much c receives every MinRateInterval and drops
+// it once the rate over MinRateWindow falls below MinRate. Intervals in
+// which nothing arrived are skipped rather than counted as slow, so a
+// client that goes quiet between bursts is left to the idle timeout.
+// The returned function stops the watch.
+func (s *Server) watchRate(c *serverConn) func() {
+	window, interval := s.MinRateWindow, s.MinRateInterval
+	if window <= 0 {
+		window = DefaultMinRateWindow
+	}
+	if interval <= 0 {
+		interval = DefaultMinRateInterval
+	}
+	samples := make([]int64, max(int(window/interval), 1))
+	minBytes := float64(s.MinRate) * (time.Duration(len(samples)) * interval).Seconds()
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		last := c.bytesRead.Load()
+		var next, filled int
+		var sum int64
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+
+			total := c.bytesRead.Load()
+			n := total - last
+			last = total
+			if n == 0 {
+				continue
+			}
+
+			sum += n - samples[next]
+			samples[next] = n
+			next = (next + 1) % len(samples)
+			filled = min(filled+1, len(samples))
+			if filled == len(samples) && float64(sum) < minBytes {
+				c.log.Warn("client too slow", "event", "slow", "remote_addr", c.RemoteAddr().String(), "min_rate", s.MinRate)
+				c.setCloseReason(ErrTooSlow)
+				c.Conn.Close()
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// maxDatagramSize is large enough for any UDP payload.
+const maxDatagramSize = 64 * 1024
+
+func isPacketNetwork(network string) bool {
+	switch network {
+	case "udp", "udp4", "udp6":
+		return true
+	}
+	return false
+}
+
+// startPacket is Start for datagram networks.
+func (s *Server) startPacket() error {
+	pc, err := net.ListenPacket(s.Network, s.Addr)
+	if err != nil {
+		return err
+	}
+
+	aux, err := s.listenAux()
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		pc.Close()
+		closeAux(aux)
+		return ErrServerClosed
+	}
+	s.packetConn = pc
+	s.aux = aux
+	s.mu.Unlock()
+
+	Logger.Info("listening", "event", "listen", "network", s.Network, "addr", pc.LocalAddr().String())
+	startAux(aux)
+	close(s.ready)
+
+	s.handlePacket(pc)
+	return ErrServerClosed
+}
+
+// handlePacket reads datagrams from pc until it is closed, logging each
+// one and writing it back to its source if s.Echo is set.
+func (s *Server) handlePacket(pc net.PacketConn) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			Logger.Error("error reading datagram", "event", "packet", "error", err)
+			continue
+		}
+
+		s.Metrics.BytesRead.Add(int64(n))
+		Logger.Info("datagram received", "event", "packet", "remote_addr", addr.String(), "bytes", n)
+
+		if s.Echo {
+			if _, err := pc.WriteTo(buf[:n], addr); err != nil {
+				Logger.Warn("error echoing datagram", "event", "packet", "remote_addr", addr.String(), "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// maxProxyHeaderLength is the longest PROXY protocol v1 header allowed by
+// the specification, including the trailing CRLF.
+const maxProxyHeaderLength = 107
+
+var (
+	// ErrProxyUnknown is returned for a "PROXY UNKNOWN" header, which
+	// carries no client address.
+	ErrProxyUnknown = errors.New("proxy protocol: unknown source")
+
+	// ErrProxyHeader is returned for a malformed PROXY protocol header.
+	ErrProxyHeader = errors.New("proxy protocol: malformed header")
+)
+
+// proxyConn is a connection whose PROXY protocol header has been
+// consumed. Reads continue from the buffered reader used to parse the
+// header, and RemoteAddr reports the client address from the header.
+type proxyConn struct {
+	bufferedConn
+	remote net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr { return c.remote }
+
+// acceptProxy reads the PROXY protocol v1 header from conn and returns a
+// connection that reports the client address it announced.
+func acceptProxy(conn net.Conn) (net.Conn, error) {
+	r := bufio.NewReader(conn)
+	remote, err := readProxyHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{bufferedConn: bufferedConn{Conn: conn, r: r}, remote: remote}, nil
+}
+
+// readProxyHeader reads a PROXY protocol v1 header such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n" from r and returns
+// the source address.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !strings.HasSuffix(string(line), "\r\n") {
+		if len(line) == maxProxyHeaderLength {
+			return nil, fmt.Errorf("%w: too long", ErrProxyHeader)
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, ErrProxyHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, ErrProxyUnknown
+	}
+	if len(fields) != 6 {
+		return nil, ErrProxyHeader
+	}
+
+	src, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: source address %q", ErrProxyHeader, fields[2])
+	}
+	if _, err := netip.ParseAddr(fields[3]); err != nil {
+		return nil, fmt.Errorf("%w: destination address %q", ErrProxyHeader, fields[3])
+	}
+	switch {
+	case fields[1] == "TCP4" && src.Is4():
+	case fields[1] == "TCP6" && src.Is6():
+	default:
+		return nil, fmt.Errorf("%w: protocol %q with address %s", ErrProxyHeader, fields[1], src)
+	}
+
+	port, err := parsePort(fields[4])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parsePort(fields[5]); err != nil {
+		return nil, err
+	}
+
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, port)), nil
+}
+
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || (len(s) > 1 && s[0] == '0') {
+		return 0, fmt.Errorf("%w: port %q", ErrProxyHeader, s)
+	}
+	return uint16(port), nil
+}
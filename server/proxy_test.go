@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string // the source address, if err is nil
+		err    error
+	}{
+		{header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", want: "192.0.2.1:56324"},
+		{header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", want: "[2001:db8::1]:56324"},
+		{header: "PROXY UNKNOWN\r\n", err: ErrProxyUnknown},
+		{header: "PROXY UNKNOWN 192.0.2.1 198.51.100.1 56324 443\r\n", err: ErrProxyUnknown},
+		{header: "GET / HTTP/1.1\r\n", err: ErrProxyHeader},
+		{header: "PROXY\r\n", err: ErrProxyHeader},
+		{header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", err: ErrProxyHeader},
+		{header: "PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n", err: ErrProxyHeader},
+		{header: "PROXY TCP6 192.0.2.1 198.51.100.1 56324 443\r\n", err: ErrProxyHeader},
+		{header: "PROXY TCP4 192.0.2.300 198.51.100.1 56324 443\r\n", err: ErrProxyHeader},
+		{header: "PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n", err: ErrProxyHeader},
+		{header: "PROXY TCP4 192.0.2.1 198.51.100.1 056324 443\r\n", err: ErrProxyHeader},
+		{header: "PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n", err: ErrProxyHeader},
+		{header: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", err: ErrProxyHeader},
+	}
+
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte(tt.header + "payload"))
+			client.Close()
+		}()
+
+		r := bufio.NewReader(server)
+		addr, err := readProxyHeader(r)
+		server.Close()
+
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("readProxyHeader(%q) = %v, %v, want error %v", tt.header, addr, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || addr.String() != tt.want {
+			t.Errorf("readProxyHeader(%q) = %v, %v, want %s", tt.header, addr, err, tt.want)
+		}
+	}
+}
+
+func TestReadProxyHeaderLeavesPayload(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nhello"))
+	if _, err := readProxyHeader(r); err != nil {
+		t.Fatalf("readProxyHeader: %v", err)
+	}
+	rest, _ := r.ReadString(0)
+	if rest != "hello" {
+		t.Errorf("after the header got %q, want %q", rest, "hello")
+	}
+}
+
+func TestProxyProtocolClientAddress(t *testing.T) {
+	s := startServer(t, func(s *Server) {
+		s.Echo = true
+		s.ProxyProtocol = true
+		_, deny, _ := net.ParseCIDR("192.0.2.0/24")
+		s.DenyCIDRs = []*net.IPNet{deny}
+	})
+
+	allowed := dial(t, s)
+	allowed.Write([]byte("PROXY TCP4 198.51.100.7 198.51.100.1 56324 443\r\n"))
+	if !echoes(t, allowed, time.Second) {
+		t.Error("client allowed by its header address not served")
+	}
+
+	denied := dial(t, s)
+	denied.Write([]byte("PROXY TCP4 192.0.2.7 198.51.100.1 56324 443\r\n"))
+	if echoes(t, denied, 200*time.Millisecond) {
+		t.Error("client denied by its header address served")
+	}
+}
+
+func TestProxyProtocolSilentClientStop(t *testing.T) {
+	s := NewServer("127.0.0.1:0")
+	s.ProxyProtocol = true
+	go s.Start()
+	<-s.Ready()
+
+	conn := dial(t, s)
+	waitFor(t, "the connection to be accepted", func() bool { return s.Metrics.Active.Load() == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Stop(ctx); err != nil {
+		t.Fatalf("Stop with a client yet to send its header: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("Read returned %v, want the connection closed", err)
+	}
+}
+
+// testTLSConfig returns a server TLS config with a fresh self-signed
+// certificate.
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestProxyProtocolTLS(t *testing.T) {
+	remotes := make(chan string, 1)
+	s := startServer(t, func(s *Server) {
+		s.Echo = true
+		s.ProxyProtocol = true
+		s.TLSConfig = testTLSConfig(t)
+		s.OnConnect = func(conn net.Conn) { remotes <- conn.RemoteAddr().String() }
+	})
+
+	// The load balancer sends the header in the clear and passes the
+	// client's TLS through after it.
+	raw := dial(t, s)
+	if _, err := raw.Write([]byte("PROXY TCP4 198.51.100.7 198.51.100.1 56324 443\r\n")); err != nil {
+		t.Fatalf("writing header: %v", err)
+	}
+	conn := tls.Client(raw, &tls.Config{InsecureSkipVerify: true})
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("TLS handshake after the PROXY header: %v", err)
+	}
+	if !echoes(t, conn, time.Second) {
+		t.Error("TLS client behind a PROXY header not served")
+	}
+	if remote := <-remotes; remote != "198.51.100.7:56324" {
+		t.Errorf("RemoteAddr = %s, want the address from the header", remote)
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// DefaultWriteQueueDepth is the write queue depth used when
+// Server.WriteQueueDepth is zero.
+const DefaultWriteQueueDepth = 64
+
+// ErrQueueFull is returned by Enqueue when a client is not reading fast
+// enough to keep up with the messages queued for it.
+var ErrQueueFull = errors.New("write queue full")
+
+// Enqueue queues msg to be written to conn by a separate writer goroutine,
+// so a slow client cannot block the caller. msg must not be modified
+// afterwards. If conn's queue is full, conn is closed and ErrQueueFull is
+// returned. Connections not accepted by a Server are written to directly.
+func Enqueue(conn net.Conn, msg []byte) error {
+	c, ok := conn.(*serverConn)
+	if !ok {
+		return writeAll(conn, msg, 0)
+	}
+	return c.enqueue(msg)
+}
+
+func (c *serverConn) enqueue(msg []byte) error {
+	c.writerOnce.Do(c.startWriter)
+
+	select {
+	case <-c.quit:
+		return net.ErrClosed
+	default:
+	}
+
+	select {
+	case c.out <- msg:
+		return nil
+	default:
+		c.setCloseReason(ErrQueueFull)
+		c.Conn.Close()
+		return ErrQueueFull
+	}
+}
+
+func (c *serverConn) startWriter() {
+	depth := c.s.WriteQueueDepth
+	if depth <= 0 {
+		depth = DefaultWriteQueueDepth
+	}
+	c.out = make(chan []byte, depth)
+	c.writerDone = make(chan struct{})
+	go c.writeLoop()
+}
+
+// writeLoop writes queued messages until stopWriter is called, then
+// flushes whatever is still queued.
+func (c *serverConn) writeLoop() {
+	defer close(c.writerDone)
+
+	for {
+		select {
+		case msg := <-c.out:
+			if !c.writeQueued(msg) {
+				return
+			}
+		case <-c.quit:
+			for {
+				select {
+				case msg := <-c.out:
+					if !c.writeQueued(msg) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// writeQueued writes msg, closing the connection if that fails so the
+// handler's reads fail too.
+func (c *serverConn) writeQueued(msg []byte) bool {
+	if err := writeAll(c, msg, c.s.WriteTimeout); err != nil {
+		c.Conn.Close()
+		return false
+	}
+	return true
+}
+
+// stopWriter stops the writer goroutine, if one was started, after it
+// has flushed the queue.
+func (c *serverConn) stopWriter() {
+	// Calling Do prevents a writer from being started from now on.
+	c.writerOnce.Do(func() {})
+	close(c.quit)
+	if c.writerDone != nil {
+		<-c.writerDone
+	}
+}
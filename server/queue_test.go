@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeServerConn returns a serverConn for s over an in-memory pipe, and
+// the client's end of the pipe. Every pipe has the same RemoteAddr, like
+// clients of a Unix socket.
+func pipeServerConn(t *testing.T, s *Server, id uint64) (*serverConn, net.Conn) {
+	t.Helper()
+
+	server, client := net.Pipe()
+	c, stop := newServerConn(context.Background(), s, server, id, time.Now(), Logger)
+	t.Cleanup(func() {
+		stop()
+		c.Close()
+		client.Close()
+		c.stopWriter()
+	})
+	return c, client
+}
+
+func TestBroadcastDropsStalledClient(t *testing.T) {
+	s := NewServer("")
+	s.WriteQueueDepth = 2
+
+	stalled, _ := pipeServerConn(t, s, 1)
+	reader, client := pipeServerConn(t, s, 2)
+	h := NewHub()
+	h.Register(stalled)
+	h.Register(reader)
+
+	// The stalled client never reads: its writer blocks on the first
+	// message and the next WriteQueueDepth fill its queue, so the one
+	// after that overflows it.
+	msg := []byte("msg\n")
+	buf := make([]byte, len(msg))
+	for i := range s.WriteQueueDepth + 4 {
+		h.Broadcast(msg)
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(client, buf); err != nil {
+			t.Fatalf("message %d: reading client: %v", i, err)
+		}
+	}
+
+	if err := stalled.closeErr(); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("stalled client close reason = %v, want %v", err, ErrQueueFull)
+	}
+	if err := reader.closeErr(); err != nil {
+		t.Errorf("reading client close reason = %v, want none", err)
+	}
+	h.mu.Lock()
+	_, stillStalled := h.clients[stalled]
+	_, stillReader := h.clients[reader]
+	h.mu.Unlock()
+	if stillStalled {
+		t.Error("stalled client still registered")
+	}
+	if !stillReader {
+		t.Error("reading client unregistered")
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimitEvictInterval is how often idle entries are dropped from a
+// rateLimiter.
+const rateLimitEvictInterval = time.Minute
+
+// rateLimiter is a set of token buckets keyed by client IP. A rate of
+// zero allows everything.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens added per second
+	burst   float64 // bucket capacity
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*bucket)}
+}
+
+// setRate allows rate events per second per key from now on, with bursts
+// of up to max(1, rate) events. Existing buckets are kept.
+func (l *rateLimiter) setRate(rate float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.burst = math.Max(1, math.Ceil(rate))
+}
+
+// allow takes a token from key's bucket and reports whether one was
+// available.
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return true
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// evict drops the buckets that have refilled completely, since a new
+// bucket for the same key would be identical.
+func (l *rateLimiter) evict(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		clear(l.buckets)
+		return
+	}
+
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// evictLoop calls evict periodically until done is closed.
+func (l *rateLimiter) evictLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(rateLimitEvictInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			l.evict(now)
+		case <-done:
+			return
+		}
+	}
+}
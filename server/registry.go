@@ -0,0 +1,82 @@
+package server
+
+import (
+	"cmp"
+	"slices"
+	"time"
+)
+
+// ConnInfo describes an active connection.
+type ConnInfo struct {
+	ID           uint64    `json:"id"`
+	RemoteAddr   string    `json:"remote_addr"`
+	ConnectedAt  time.Time `json:"connected_at"`
+	LastActivity time.Time `json:"last_activity"`
+	BytesRead    int64     `json:"bytes_read"`
+	BytesWritten int64     `json:"bytes_written"`
+}
+
+// Conns returns the connections currently being served, ordered by ID.
+func (s *Server) Conns() []ConnInfo {
+	s.mu.Lock()
+	conns := make([]ConnInfo, 0, len(s.registry))
+	for _, c := range s.registry {
+		conns = append(conns, c.info())
+	}
+	s.mu.Unlock()
+
+	sortConns(conns)
+	return conns
+}
+
+// openConns describes every tracked connection, ordered by ID. Those
+// still before their handler, such as waiting for a PROXY header, are
+// not in the registry yet and are described from the socket as
+// accepted. s.mu must be held.
+func (s *Server) openConns() []ConnInfo {
+	conns := make([]ConnInfo, 0, len(s.conns))
+	for conn, t := range s.conns {
+		if c, ok := s.registry[t.id]; ok {
+			conns = append(conns, c.info())
+			continue
+		}
+		conns = append(conns, ConnInfo{
+			ID:           t.id,
+			RemoteAddr:   conn.RemoteAddr().String(),
+			ConnectedAt:  t.accepted,
+			LastActivity: t.accepted,
+		})
+	}
+	sortConns(conns)
+	return conns
+}
+
+// sortConns orders conns by ID.
+func sortConns(conns []ConnInfo) {
+	slices.SortFunc(conns, func(a, b ConnInfo) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+}
+
+func (s *Server) register(c *serverConn) {
+	s.mu.Lock()
+	s.registry[c.id] = c
+	s.mu.Unlock()
+}
+
+func (s *Server) unregister(c *serverConn) {
+	s.mu.Lock()
+	delete(s.registry, c.id)
+	s.mu.Unlock()
+}
+
+func (c *serverConn) info() ConnInfo {
+	return ConnInfo{
+		ID:           c.id,
+		RemoteAddr:   c.RemoteAddr().String(),
+		ConnectedAt:  c.connectedAt,
+		LastActivity: time.Unix(0, c.lastActivity.Load()),
+		BytesRead:    c.bytesRead.Load(),
+		BytesWritten: c.bytesWritten.Load(),
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !(darwin || dragonfly || freebsd || netbsd || openbsd || (linux && !(mips || mipsle || mips64 || mips64le)))
+
+package server
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setReusePort fails: SO_REUSEPORT is not supported on this platform.
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,17 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd || (linux && !(mips || mipsle || mips64 || mips64le))
+
+package server
+
+import "syscall"
+
+// setReusePort sets SO_REUSEPORT on a socket about to be bound, so that
+// several listeners can share its port.
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
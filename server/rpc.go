@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// Status bytes that start each response frame written by Serve.
+const (
+	StatusOK    byte = 0
+	StatusError byte = 1
+)
+
+// ErrRequestTimeout is reported to the client in an error frame when a
+// handler passed to Serve runs longer than Server.RequestTimeout.
+var ErrRequestTimeout = errors.New("request timed out")
+
+// Serve reads request frames from conn (see ReadFrame), passes each to
+// handler and writes the result back as a frame whose payload starts
+// with a status byte: StatusOK followed by the response, or StatusError
+// followed by the error text if handler failed. Requests are handled one
+// at a time, in order.
+//
+// On connections accepted by a Server, frames are limited to
+// MaxFrameSize and a handler that runs longer than RequestTimeout is
+// answered with ErrRequestTimeout; it keeps running in the background,
+// but its result is discarded. Serve returns when reading a request or
+// writing a response fails, or the server is stopped.
+func Serve(conn net.Conn, handler func(req []byte) ([]byte, error)) error {
+	ctx, max, timeout := context.Background(), DefaultMaxFrameSize, time.Duration(0)
+	if c, ok := conn.(*serverConn); ok {
+		ctx, timeout = c.ctx, c.s.RequestTimeout
+		if c.s.MaxFrameSize > 0 {
+			max = c.s.MaxFrameSize
+		}
+	}
+
+	for {
+		req, err := readFrame(conn, max)
+		if err != nil {
+			if errors.Is(err, ErrFrameTooLarge) {
+				setCloseReason(conn, err)
+			}
+			return err
+		}
+
+		resp, err := callHandler(ctx, timeout, handler, req)
+		if err != nil {
+			resp = append([]byte{StatusError}, err.Error()...)
+		} else {
+			resp = append([]byte{StatusOK}, resp...)
+		}
+		if err := WriteFrame(conn, resp); err != nil {
+			return err
+		}
+	}
+}
+
+// callHandler runs handler on req, giving up once timeout has passed or
+// ctx is done.
+func callHandler(ctx context.Context, timeout time.Duration, handler func([]byte) ([]byte, error), req []byte) ([]byte, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	type result struct {
+		resp []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := handler(req)
+		done <- result{resp, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.resp, r.err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, ErrRequestTimeout
+		}
+		return nil, ErrServerClosed
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServe(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	s := startServer(t, func(s *Server) {
+		s.RequestTimeout = 100 * time.Millisecond
+		s.Handler = HandlerFunc(func(ctx context.Context, conn net.Conn) {
+			Serve(conn, func(req []byte) ([]byte, error) {
+				switch string(req) {
+				case "fail":
+					return nil, errors.New("bad request")
+				case "slow":
+					<-release
+				}
+				return bytes.ToUpper(req), nil
+			})
+		})
+	})
+
+	conn := dial(t, s)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	// The requests share a connection, so each also checks the ones
+	// before it left it usable.
+	tests := []struct {
+		req  string
+		resp []byte
+	}{
+		{"hello", append([]byte{StatusOK}, "HELLO"...)},
+		{"fail", append([]byte{StatusError}, "bad request"...)},
+		{"slow", append([]byte{StatusError}, ErrRequestTimeout.Error()...)},
+		{"again", append([]byte{StatusOK}, "AGAIN"...)},
+	}
+	for _, tt := range tests {
+		if err := WriteFrame(conn, []byte(tt.req)); err != nil {
+			t.Fatalf("writing %q: %v", tt.req, err)
+		}
+		resp, err := ReadFrame(conn)
+		if err != nil {
+			t.Fatalf("reading response to %q: %v", tt.req, err)
+		}
+		if !bytes.Equal(resp, tt.resp) {
+			t.Errorf("response to %q = %q, want %q", tt.req, resp, tt.resp)
+		}
+	}
+}
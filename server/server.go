@@ -0,0 +1,674 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ErrServerClosed is returned by Start after Stop has been called.
+var ErrServerClosed = errors.New("server closed")
+
+// DefaultReadBufferSize is the read buffer size used when
+// Server.ReadBufferSize is zero.
+const DefaultReadBufferSize = 1024
+
+// DefaultMaxLineLength is the line length limit used when
+// Server.MaxLineLength is zero.
+const DefaultMaxLineLength = 64 * 1024
+
+// Server accepts connections on Addr and runs Handler for each one in
+// its own goroutine.
+type Server struct {
+	// Network is "tcp" (the default when empty), "unix" or "udp". "tcp"
+	// listens on both IPv4 and IPv6 where the address allows it; "tcp4",
+	// "tcp6", "udp4" and "udp6" pin the address family. For
+	// "unix", Addr is the socket path; a stale socket file left behind by
+	// a previous run is removed, and the file is unlinked again by Stop.
+	// For "udp" there are no connections: each datagram is logged and,
+	// if Echo is set, written back to its source. Handler and the
+	// connection settings are not used.
+	Network string
+	Addr    string
+
+	// Addrs lists further addresses to listen on alongside Addr. All
+	// listeners share Handler and the connection limits. Addrs is not
+	// used for "udp".
+	Addrs []string
+
+	// Listeners, if greater than one, is how many listeners to open on
+	// each TCP address, sharing the port with SO_REUSEPORT, each with its
+	// own accept loop. Where SO_REUSEPORT is not available a single
+	// listener is used and a warning logged. SO_REUSEPORT also lets
+	// another process that sets it bind the same port and take a share of
+	// the connections, so sharding is off unless asked for.
+	Listeners int
+
+	// Handler serves every accepted connection. If nil, a handler is
+	// chosen from FrameHandler, JSONHandlers, LineHandler and Echo,
+	// falling back to DiscardHandler.
+	Handler Handler
+
+	// ProxyProtocol makes the server expect a PROXY protocol v1
+	// header at the start of each connection and report the client
+	// address it carries instead of the socket peer. Connections with a
+	// missing, malformed or "PROXY UNKNOWN" header are closed, as are
+	// those that do not send it within HandshakeTimeout of being
+	// accepted (or IdleTimeout, capped at ten seconds, if that is not
+	// set). AllowCIDRs, DenyCIDRs and RateLimit apply to the address
+	// from the header.
+	ProxyProtocol bool
+
+	// Banner, if set, is written to each connection before the handler
+	// runs, with "\r\n" appended if missing. It should not be combined
+	// with DetectHTTP, which withholds the banner until the client has
+	// sent something.
+	Banner string
+
+	// OnConnect, if set, is called with each connection before its
+	// handler runs, and OnDisconnect after the connection has ended with
+	// the reason it ended: io.EOF when the client closed it,
+	// ErrServerClosed on shutdown, a net.Error whose Timeout method
+	// reports true for an idle timeout, one of the other Err values of
+	// this package, or the read or write error. The error is nil if the
+	// handler returned on its own. Both run in the connection's goroutine,
+	// so slow work should be handed off elsewhere.
+	OnConnect    func(conn net.Conn)
+	OnDisconnect func(conn net.Conn, err error)
+
+	// DetectHTTP makes the server answer connections that start with an
+	// HTTP request line, such as load balancer health checks, with
+	// "200 OK" and close them. Other connections are passed to the
+	// handler with nothing consumed. Clients must therefore send first;
+	// see Banner.
+	DetectHTTP bool
+
+	// MaxConnBytes, if positive, is the most a client may send over the
+	// life of a connection. A client that sends more is disconnected;
+	// the bytes up to the limit are still passed to the handler.
+	MaxConnBytes int64
+
+	// MinRate, if positive, is the slowest a client may send, in bytes
+	// per second averaged over MinRateWindow, before it is disconnected.
+	// The rate is sampled every MinRateInterval, and only intervals in
+	// which the client sent something count. Zero MinRateWindow and
+	// MinRateInterval mean DefaultMinRateWindow and
+	// DefaultMinRateInterval.
+	MinRate         int64
+	MinRateWindow   time.Duration
+	MinRateInterval time.Duration
+
+	// WriteTimeout, if positive, bounds each write to a client. A client
+	// that does not accept the data in time is disconnected.
+	WriteTimeout time.Duration
+
+	// HandshakeTimeout, if positive, closes connections that send nothing
+	// within this long of being accepted. It covers the PROXY header, if
+	// any, and lasts until the first bytes after it arrive, after which
+	// IdleTimeout takes over.
+	HandshakeTimeout time.Duration
+
+	// IdleTimeout closes connections that send nothing for this long.
+	// Zero means no timeout. It can be changed later with Reload, as can
+	// AllowCIDRs, DenyCIDRs and RateLimit.
+	IdleTimeout time.Duration
+
+	// MaxConnLifetime, if positive, closes connections this long after
+	// they were accepted, whether or not they are active.
+	MaxConnLifetime time.Duration
+
+	// KeepAlivePeriod, if positive, enables TCP keepalive probes at this
+	// interval on accepted connections.
+	KeepAlivePeriod time.Duration
+
+	// DisableNoDelay turns off TCP_NODELAY, which Go sets on TCP
+	// connections by default, so the kernel may coalesce small writes.
+	// Leave it false for request/response protocols sensitive to latency.
+	DisableNoDelay bool
+
+	// AllowCIDRs, if not empty, restricts clients to these networks.
+	// DenyCIDRs refuses clients from these networks, even if they are
+	// also in AllowCIDRs.
+	AllowCIDRs []*net.IPNet
+	DenyCIDRs  []*net.IPNet
+
+	// RateLimit, if positive, limits how many connections per second
+	// each client IP may open. Connections over the limit are closed
+	// immediately.
+	RateLimit float64
+
+	// MaxConns limits the number of connections served at once. Zero
+	// means no limit.
+	MaxConns int
+
+	// RejectWhenFull makes the server close new connections while
+	// MaxConns are active instead of waiting for a slot to free up.
+	RejectWhenFull bool
+
+	// WriteQueueDepth is how many messages may be queued for a client
+	// with Enqueue before it is considered too slow and disconnected.
+	// Zero means DefaultWriteQueueDepth.
+	WriteQueueDepth int
+
+	// ReadBufferSize is the size of the buffer DiscardHandler and
+	// EchoHandler read into when Handler is nil. Buffers are pooled and
+	// reused across connections. Zero means DefaultReadBufferSize.
+	ReadBufferSize int
+
+	// Echo selects EchoHandler when Handler is nil.
+	Echo bool
+
+	// FastEcho makes Echo select FastEchoHandler instead. It has no
+	// effect while the limits listed there are set.
+	FastEcho bool
+
+	// LineHandler, if set and Handler is nil, splits the stream into
+	// newline-terminated lines and calls LineHandler once per line. The
+	// line excludes the trailing newline and is only valid until
+	// LineHandler returns.
+	LineHandler func(conn net.Conn, line []byte)
+
+	// PingPong makes the line-based modes answer a "PING" line, in any
+	// case, with "PONG" instead of passing it on. Clients can use it as a
+	// heartbeat that keeps the connection within IdleTimeout.
+	PingPong bool
+
+	// MaxLineLength is the longest line accepted in line mode. Clients
+	// that exceed it are disconnected. Zero means DefaultMaxLineLength.
+	MaxLineLength int
+
+	// FrameHandler, if set and Handler is nil, reads length-prefixed
+	// frames (see ReadFrame) and calls FrameHandler once per frame. It
+	// takes precedence over LineHandler.
+	FrameHandler func(conn net.Conn, payload []byte)
+
+	// MaxFrameSize is the largest frame payload accepted in frame mode.
+	// Zero means DefaultMaxFrameSize.
+	MaxFrameSize int
+
+	// RequestTimeout, if positive, bounds how long a handler passed to
+	// Serve may take to answer a request.
+	RequestTimeout time.Duration
+
+	// JSONHandlers, if set and Handler and FrameHandler are nil, reads
+	// newline-delimited JSON objects and calls the function registered
+	// for each object's "type" field with the whole object. Lines are
+	// limited to MaxLineLength. Malformed objects and unknown types are
+	// answered with {"type":"error","error":"..."}.
+	JSONHandlers map[string]func(conn net.Conn, msg json.RawMessage)
+
+	// StrictJSON makes the server disconnect a client after answering a
+	// malformed JSON object, instead of skipping it.
+	StrictJSON bool
+
+	// TLSConfig, if set, makes the server accept TLS connections only.
+	// With ProxyProtocol, the header is expected in the clear before the
+	// TLS handshake, as sent by a load balancer passing TLS through.
+	TLSConfig *tls.Config
+
+	// MetricsAddr, if set, is the address of a second listener that
+	// writes a plain-text snapshot of Metrics to each connection.
+	MetricsAddr string
+
+	// AdminAddr, if set, is the address of a listener that answers one
+	// command per connection, such as "conns" to list the active
+	// connections. See Conns.
+	AdminAddr string
+
+	// Metrics counts connections and traffic.
+	Metrics Metrics
+
+	mu         sync.Mutex
+	listeners  []net.Listener
+	packetConn net.PacketConn
+	aux        []auxListener
+	registry   map[uint64]*serverConn
+	conns      map[net.Conn]trackedConn
+	closed     bool
+	draining   bool
+	done       chan struct{}
+	ready      chan struct{}
+	wg         sync.WaitGroup
+	sem        chan struct{}
+	limiter    *rateLimiter
+	settings   atomic.Pointer[Settings]
+	cancel     context.CancelFunc
+	nextID     atomic.Uint64
+}
+
+// NewServer returns a Server that will listen on addr.
+func NewServer(addr string) *Server {
+	return &Server{
+		Addr:     addr,
+		conns:    make(map[net.Conn]trackedConn),
+		registry: make(map[uint64]*serverConn),
+		limiter:  newRateLimiter(),
+		done:     make(chan struct{}),
+		ready:    make(chan struct{}),
+	}
+}
+
+// Ready returns a channel that is closed once Start has bound its
+// listeners and is accepting connections, after which ListenAddr reports
+// the bound address. If Start fails the channel is never closed, so
+// callers should also watch Start's result.
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// ListenAddr returns the address the server is listening on for Addr,
+// or nil if it is not listening yet. This is useful when Addr was given
+// with port 0. It is not called Addr because that is the field naming
+// the address to listen on.
+func (s *Server) ListenAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case len(s.listeners) > 0:
+		return s.listeners[0].Addr()
+	case s.packetConn != nil:
+		return s.packetConn.LocalAddr()
+	}
+	return nil
+}
+
+// Start listens on s.Addr and s.Addrs and serves connections until Stop
+// is called. It always returns a non-nil error; after Stop it returns
+// ErrServerClosed.
+func (s *Server) Start() error {
+	if isPacketNetwork(s.Network) {
+		return s.startPacket()
+	}
+
+	listeners, err := s.listenAll()
+	if err != nil {
+		return err
+	}
+
+	aux, err := s.listenAux()
+	if err != nil {
+		closeListeners(listeners)
+		return err
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		closeListeners(listeners)
+		closeAux(aux)
+		return ErrServerClosed
+	}
+	s.listeners = listeners
+	s.aux = aux
+	if s.draining {
+		closeListeners(listeners)
+	}
+	if s.MaxConns > 0 {
+		s.sem = make(chan struct{}, s.MaxConns)
+	}
+	if s.settings.Load() == nil {
+		s.settings.Store(s.current())
+	}
+	s.limiter.setRate(s.current().RateLimit)
+	go s.limiter.evictLoop(s.done)
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.mu.Unlock()
+	defer cancel()
+
+	for _, l := range listeners {
+		Logger.Info("listening", "event", "listen", "network", s.network(), "addr", l.Addr().String())
+	}
+	startAux(aux)
+	close(s.ready)
+
+	errc := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func() {
+			errc <- s.acceptConns(ctx, l)
+		}()
+	}
+	err = <-errc
+	if errors.Is(err, errDraining) {
+		// Keep ctx alive for the connections still being served.
+		<-s.done
+		return ErrServerClosed
+	}
+	if !errors.Is(err, ErrServerClosed) {
+		closeListeners(listeners)
+	}
+	return err
+}
+
+// errDraining is returned by acceptConns when its listener was closed by
+// Drain.
+var errDraining = errors.New("server draining")
+
+// Drain stops the server from accepting connections by closing its
+// listeners, while the connections already being served carry on. Start
+// keeps running until Stop is called, which then closes those that
+// remain. The metrics and admin listeners stay open so health checks can
+// see the server is draining. Drain has no effect on packet networks.
+func (s *Server) Drain() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.draining {
+		return
+	}
+	s.draining = true
+	s.Metrics.Draining.Store(true)
+	closeListeners(s.listeners)
+	Logger.Info("draining", "event", "drain", "conns", len(s.conns))
+}
+
+// acceptConns accepts connections on l and serves each in its own
+// goroutine. The accept loops of all listeners share the MaxConns limit;
+// a loop takes a slot after Accept so that one idle listener cannot hold
+// a slot the others need.
+func (s *Server) acceptConns(ctx context.Context, l net.Listener) error {
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if s.isDraining() {
+				return errDraining
+			}
+			s.Metrics.AcceptErrors.Add(1)
+			if !isTemporary(err) {
+				Logger.Error("error accepting", "event", "accept", "error", err)
+				return err
+			}
+
+			delay = min(max(2*delay, minAcceptDelay), maxAcceptDelay)
+			Logger.Error("error accepting, retrying", "event", "accept", "error", err, "delay", delay.String())
+			select {
+			case <-time.After(delay):
+			case <-s.done:
+				return ErrServerClosed
+			}
+			continue
+		}
+		delay = 0
+		accepted := time.Now()
+
+		s.Metrics.Accepted.Add(1)
+
+		id := s.nextID.Add(1)
+		log := Logger.With("conn_id", id)
+
+		if !s.admit(conn, log) {
+			conn.Close()
+			continue
+		}
+
+		if s.sem != nil && !s.RejectWhenFull {
+			select {
+			case s.sem <- struct{}{}:
+			case <-s.done:
+				conn.Close()
+				return ErrServerClosed
+			}
+		}
+
+		if !s.track(conn, id, accepted) {
+			s.release()
+			conn.Close()
+			return ErrServerClosed
+		}
+		go s.serve(ctx, conn, id, accepted, log)
+	}
+}
+
+// Bounds of the delay before retrying after a temporary Accept error.
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// isTemporary reports whether the Accept error err may go away on its own,
+// such as running out of file descriptors.
+func isTemporary(err error) bool {
+	switch {
+	case errors.Is(err, syscall.EMFILE),
+		errors.Is(err, syscall.ENFILE),
+		errors.Is(err, syscall.ENOBUFS),
+		errors.Is(err, syscall.ENOMEM),
+		errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.ECONNRESET):
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// admit decides whether a freshly accepted conn may be served, logging
+// the reason if not. In RejectWhenFull mode it also takes the MaxConns
+// slot for conn. With ProxyProtocol the client address is not known
+// yet, so serve checks it with admitClient once the header is read.
+func (s *Server) admit(conn net.Conn, log *slog.Logger) bool {
+	if !s.ProxyProtocol && !s.admitClient(conn.RemoteAddr(), log) {
+		return false
+	}
+
+	if s.sem != nil && s.RejectWhenFull {
+		select {
+		case s.sem <- struct{}{}:
+		default:
+			log.Warn("connection rejected: limit reached", "event", "reject", "remote_addr", conn.RemoteAddr().String())
+			return false
+		}
+	}
+	return true
+}
+
+// admitClient applies AllowCIDRs, DenyCIDRs and RateLimit to the client
+// at addr, logging the reason if it is refused.
+func (s *Server) admitClient(addr net.Addr, log *slog.Logger) bool {
+	if !s.allowed(addr) {
+		log.Warn("connection denied", "event", "deny", "remote_addr", addr.String())
+		return false
+	}
+
+	if ip, ok := remoteIP(addr); ok && !s.limiter.allow(ip.String(), time.Now()) {
+		log.Warn("connection rejected: rate limited", "event", "ratelimit", "remote_addr", addr.String())
+		return false
+	}
+	return true
+}
+
+// listenAll opens a listener on s.Addr and each of s.Addrs. If any fails,
+// the ones already opened are closed.
+func (s *Server) listenAll() ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range append([]string{s.Addr}, s.Addrs...) {
+		var ls []net.Listener
+		var err error
+		if s.Listeners > 1 && strings.HasPrefix(s.network(), "tcp") {
+			ls, err = s.listenShards(addr)
+		} else {
+			var l net.Listener
+			l, err = s.listen(addr)
+			ls = []net.Listener{l}
+		}
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		for _, l := range ls {
+			// With ProxyProtocol the header comes before the TLS
+			// handshake, so serve starts TLS once it has read it.
+			if s.TLSConfig != nil && !s.ProxyProtocol {
+				l = tls.NewListener(l, s.TLSConfig)
+			}
+			listeners = append(listeners, l)
+		}
+	}
+	return listeners, nil
+}
+
+// listenShards opens s.Listeners listeners on addr that share its port
+// with SO_REUSEPORT, so the kernel spreads new connections across their
+// accept loops. If the option cannot be set it falls back to a single
+// listener.
+func (s *Server) listenShards(addr string) ([]net.Listener, error) {
+	ctx := context.Background()
+	lc := net.ListenConfig{Control: setReusePort}
+
+	first, err := lc.Listen(ctx, s.network(), addr)
+	if err != nil {
+		l, lerr := s.listen(addr)
+		if lerr != nil {
+			return nil, lerr
+		}
+		Logger.Warn("SO_REUSEPORT not available, using a single listener", "event", "listen", "addr", addr, "error", err)
+		return []net.Listener{l}, nil
+	}
+
+	// Bind the rest to the port the first got, in case addr has port 0.
+	listeners := []net.Listener{first}
+	for len(listeners) < s.Listeners {
+		l, err := lc.Listen(ctx, s.network(), first.Addr().String())
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	Logger.Warn("listening with SO_REUSEPORT, other processes can bind the same port", "event", "listen", "addr", first.Addr().String(), "listeners", len(listeners))
+	return listeners, nil
+}
+
+// network returns s.Network, defaulting to "tcp".
+func (s *Server) network() string {
+	if s.Network == "" {
+		return "tcp"
+	}
+	return s.Network
+}
+
+func (s *Server) listen(addr string) (net.Listener, error) {
+	network := s.network()
+	if network == "unix" {
+		if err := removeStaleSocket(addr); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen(network, addr)
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// Stop closes the listeners, cancels the context passed to handlers and
+// waits for active connections to finish. Reads pending on connections
+// fail with ErrServerClosed so handlers blocked in Read return promptly.
+// If ctx expires first, the remaining connections are logged and closed
+// and ctx's error is returned.
+func (s *Server) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+	closeListeners(s.listeners)
+	if s.packetConn != nil {
+		s.packetConn.Close()
+	}
+	closeAux(s.aux)
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		now := time.Now()
+		for _, c := range s.openConns() {
+			Logger.Warn("connection still open at shutdown",
+				"event", "shutdown",
+				"conn_id", c.ID,
+				"remote_addr", c.RemoteAddr,
+				"age", now.Sub(c.ConnectedAt).Round(time.Millisecond).String(),
+				"last_activity", c.LastActivity.Format(time.RFC3339Nano))
+		}
+		Logger.Warn("shutdown timed out, closing connections", "event", "shutdown", "conns", len(s.conns))
+		for conn := range s.conns {
+			conn.Close()
+		}
+		return ctx.Err()
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// trackedConn is what the server records about an accepted connection
+// from accept until serve returns.
+type trackedConn struct {
+	id       uint64
+	accepted time.Time
+}
+
+// track registers conn as active. It reports false if the server has
+// already been stopped.
+func (s *Server) track(conn net.Conn, id uint64, accepted time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = trackedConn{id: id, accepted: accepted}
+	s.wg.Add(1)
+	s.Metrics.Active.Add(1)
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.Metrics.Active.Add(-1)
+	s.release()
+	s.wg.Done()
+}
+
+// release frees a MaxConns slot taken in the accept loop.
+func (s *Server) release() {
+	if s.sem != nil {
+		<-s.sem
+	}
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	os.Exit(m.Run())
+}
+
+// startServer starts a server on a free loopback port, after letting
+// setup configure it, and stops it when the test ends.
+func startServer(t testing.TB, setup func(s *Server)) *Server {
+	t.Helper()
+
+	s := NewServer("127.0.0.1:0")
+	if setup != nil {
+		setup(s)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.Start()
+	}()
+	select {
+	case <-s.Ready():
+	case err := <-errc:
+		t.Fatalf("Start: %v", err)
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Stop(ctx)
+	})
+	return s
+}
+
+// dial connects to s and closes the connection when the test ends.
+func dial(t testing.TB, s *Server) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", s.ListenAddr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// waitFor polls cond until it reports true, failing the test after a
+// second.
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// echoes reports whether conn echoes a byte back within timeout.
+func echoes(t testing.TB, conn net.Conn, timeout time.Duration) bool {
+	t.Helper()
+
+	if _, err := conn.Write([]byte("x")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var buf [1]byte
+	_, err := conn.Read(buf[:])
+	return err == nil
+}
+
+// isTimeout reports whether err is a timeout.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func TestMaxConnsRejectWhenFull(t *testing.T) {
+	s := startServer(t, func(s *Server) {
+		s.Echo = true
+		s.MaxConns = 2
+		s.RejectWhenFull = true
+	})
+
+	for range s.MaxConns {
+		if conn := dial(t, s); !echoes(t, conn, time.Second) {
+			t.Fatal("connection within the limit not served")
+		}
+	}
+
+	conn := dial(t, s)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	if err == nil || isTimeout(err) {
+		t.Fatalf("connection over the limit: Read returned %v, want it closed", err)
+	}
+}
+
+func TestMaxConnsBlocking(t *testing.T) {
+	s := startServer(t, func(s *Server) {
+		s.Echo = true
+		s.MaxConns = 2
+	})
+
+	var conns []net.Conn
+	for range s.MaxConns {
+		conn := dial(t, s)
+		if !echoes(t, conn, time.Second) {
+			t.Fatal("connection within the limit not served")
+		}
+		conns = append(conns, conn)
+	}
+
+	waiting := dial(t, s)
+	if echoes(t, waiting, 100*time.Millisecond) {
+		t.Fatal("connection over the limit served while the limit was reached")
+	}
+
+	conns[0].Close()
+	var buf [1]byte
+	waiting.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := waiting.Read(buf[:]); err != nil {
+		t.Fatalf("waiting connection not served after a slot freed up: %v", err)
+	}
+}
+
+func TestStopUnblocksRead(t *testing.T) {
+	returned := make(chan time.Time, 1)
+	s := NewServer("127.0.0.1:0")
+	s.Handler = HandlerFunc(func(ctx context.Context, conn net.Conn) {
+		conn.Read(make([]byte, 1))
+		returned <- time.Now()
+	})
+	go s.Start()
+	<-s.Ready()
+
+	dial(t, s)
+	waitFor(t, "the connection to be served", func() bool { return len(s.Conns()) == 1 })
+
+	stopped := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Stop(ctx); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+
+	select {
+	case at := <-returned:
+		if d := at.Sub(stopped); d > 50*time.Millisecond {
+			t.Errorf("Read returned %v after Stop, want within 50ms", d)
+		}
+	default:
+		t.Fatal("handler still blocked in Read after Stop returned")
+	}
+}
+
+func TestReady(t *testing.T) {
+	s := NewServer("127.0.0.1:0")
+	s.Echo = true
+	if addr := s.ListenAddr(); addr != nil {
+		t.Fatalf("ListenAddr before Start = %v, want nil", addr)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- s.Start() }()
+	select {
+	case <-s.Ready():
+	case err := <-errc:
+		t.Fatalf("Start: %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("Ready not closed after Start")
+	}
+	defer s.Stop(context.Background())
+
+	if !echoes(t, dial(t, s), time.Second) {
+		t.Error("connection made after Ready not served")
+	}
+}
+
+func TestReadyStartFails(t *testing.T) {
+	taken := startServer(t, nil)
+
+	s := NewServer(taken.ListenAddr().String())
+	if err := s.Start(); err == nil {
+		t.Fatal("Start on an address in use succeeded")
+	}
+	select {
+	case <-s.Ready():
+		t.Error("Ready closed although Start failed")
+	default:
+	}
+}
+
+func BenchmarkAccept(b *testing.B) {
+	for _, listeners := range []int{1, 4} {
+		b.Run(fmt.Sprintf("listeners=%d", listeners), func(b *testing.B) {
+			s := startServer(b, func(s *Server) {
+				s.Listeners = listeners
+				s.Handler = HandlerFunc(func(ctx context.Context, conn net.Conn) {})
+			})
+			addr := s.ListenAddr().String()
+
+			b.RunParallel(func(pb *testing.PB) {
+				var buf [1]byte
+				for pb.Next() {
+					conn, err := net.Dial("tcp", addr)
+					if err != nil {
+						b.Errorf("Dial: %v", err)
+						return
+					}
+					// Wait for the server to close first, so the
+					// client's ports do not pile up in TIME_WAIT.
+					conn.Read(buf[:])
+					conn.Close()
+				}
+			})
+		})
+	}
+}
+
+// logRecorder collects the records logged as JSON lines.
+type logRecorder struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (r *logRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf.Write(p)
+}
+
+// records returns the records logged with msg.
+func (r *logRecorder) records(t *testing.T, msg string) []map[string]any {
+	t.Helper()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var records []map[string]any
+	for _, line := range bytes.Split(bytes.TrimSpace(r.buf.Bytes()), []byte("\n")) {
+		var rec map[string]any
+		if err := json.Unmarshal(line, &rec); err != nil {
+			t.Fatalf("parsing log line %q: %v", line, err)
+		}
+		if rec["msg"] == msg {
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+// recordLogs sends Logger's output to the returned recorder until the
+// test ends.
+func recordLogs(t *testing.T) *logRecorder {
+	r := &logRecorder{}
+	old := Logger
+	Logger = slog.New(slog.NewJSONHandler(r, nil))
+	t.Cleanup(func() { Logger = old })
+	return r
+}
+
+func TestStopTimeoutLogsOpenConns(t *testing.T) {
+	logs := recordLogs(t)
+	release := make(chan struct{})
+	defer close(release)
+	s := startServer(t, func(s *Server) {
+		// A handler that ignores ctx keeps Stop waiting.
+		s.Handler = HandlerFunc(func(ctx context.Context, conn net.Conn) { <-release })
+	})
+	dial(t, s)
+	dial(t, s)
+	waitFor(t, "both connections to be served", func() bool { return len(s.Conns()) == 2 })
+
+	// One more connection, tracked but not yet handed to its handler.
+	server, client := net.Pipe()
+	defer client.Close()
+	s.track(server, 100, time.Now())
+	defer s.untrack(server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Stop returned %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	open := logs.records(t, "connection still open at shutdown")
+	var ids []float64
+	for _, rec := range open {
+		ids = append(ids, rec["conn_id"].(float64))
+	}
+	if want := []float64{1, 2, 100}; !slices.Equal(ids, want) {
+		t.Errorf("logged open connections %v, want %v", ids, want)
+	}
+	summary := logs.records(t, "shutdown timed out, closing connections")
+	if len(summary) != 1 {
+		t.Fatalf("got %d shutdown summaries, want 1", len(summary))
+	}
+	if n := summary[0]["conns"]; n != float64(len(open)) {
+		t.Errorf("summary counts %v connections, per-connection lines %d", n, len(open))
+	}
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Settings are the parameters that can be changed on a running server
+// with Reload. Start takes their initial values from the Server fields of
+// the same names.
+type Settings struct {
+	IdleTimeout time.Duration
+	RateLimit   float64
+	AllowCIDRs  []*net.IPNet
+	DenyCIDRs   []*net.IPNet
+}
+
+// current returns the settings in effect.
+func (s *Server) current() *Settings {
+	if st := s.settings.Load(); st != nil {
+		return st
+	}
+	return &Settings{
+		IdleTimeout: s.IdleTimeout,
+		RateLimit:   s.RateLimit,
+		AllowCIDRs:  s.AllowCIDRs,
+		DenyCIDRs:   s.DenyCIDRs,
+	}
+}
+
+// Reload replaces the server's Settings. Connections accepted from now on
+// are filtered and rate limited with the new values, and live connections
+// use the new IdleTimeout from their next read. Each changed setting is
+// logged.
+func (s *Server) Reload(st Settings) {
+	old := s.current()
+	s.settings.Store(&st)
+	s.limiter.setRate(st.RateLimit)
+
+	changes := []struct {
+		name     string
+		old, new string
+	}{
+		{"idle_timeout", old.IdleTimeout.String(), st.IdleTimeout.String()},
+		{"rate_limit", fmt.Sprint(old.RateLimit), fmt.Sprint(st.RateLimit)},
+		{"allow_cidrs", formatCIDRs(old.AllowCIDRs), formatCIDRs(st.AllowCIDRs)},
+		{"deny_cidrs", formatCIDRs(old.DenyCIDRs), formatCIDRs(st.DenyCIDRs)},
+	}
+	n := 0
+	for _, c := range changes {
+		if c.old != c.new {
+			Logger.Info("setting changed", "event", "reload", "setting", c.name, "old", c.old, "new", c.new)
+			n++
+		}
+	}
+	Logger.Info("settings reloaded", "event", "reload", "changed", n)
+}
+
+func formatCIDRs(nets []*net.IPNet) string {
+	s := make([]string, len(nets))
+	for i, n := range nets {
+		s[i] = n.String()
+	}
+	return strings.Join(s, ",")
+}
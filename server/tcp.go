@@ -0,0 +1,56 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// tcpConn returns the *net.TCPConn underlying conn, looking through TLS
+// and the server's own wrappers.
+func tcpConn(conn net.Conn) (*net.TCPConn, bool) {
+	for {
+		w, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = w.NetConn()
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	return tcp, ok
+}
+
+// configureConn applies the server's socket options to conn.
+func (s *Server) configureConn(conn net.Conn, log *slog.Logger) {
+	if s.KeepAlivePeriod <= 0 && !s.DisableNoDelay {
+		return
+	}
+
+	tcp, ok := tcpConn(conn)
+	if !ok {
+		log.Warn("tcp socket options not supported", "event", "configure", "remote_addr", conn.RemoteAddr().String())
+		return
+	}
+	if s.DisableNoDelay {
+		if err := tcp.SetNoDelay(false); err != nil {
+			log.Warn("error disabling nodelay", "event", "configure", "remote_addr", conn.RemoteAddr().String(), "error", err)
+		}
+	}
+	if s.KeepAlivePeriod > 0 {
+		if err := setKeepAlive(tcp, s.KeepAlivePeriod); err != nil {
+			log.Warn("error configuring keepalive", "event", "configure", "remote_addr", conn.RemoteAddr().String(), "error", err)
+		}
+	}
+}
+
+// setKeepAlive enables TCP keepalive on tcp with the given period.
+func setKeepAlive(tcp *net.TCPConn, period time.Duration) error {
+	if err := tcp.SetKeepAlive(true); err != nil {
+		return fmt.Errorf("enabling keepalive: %w", err)
+	}
+	if err := tcp.SetKeepAlivePeriod(period); err != nil {
+		return fmt.Errorf("setting keepalive period: %w", err)
+	}
+	return nil
+}
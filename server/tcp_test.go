@@ -0,0 +1,37 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSetKeepAlive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer conn.Close()
+
+	// Look through the wrappers serve puts around accepted connections.
+	wrapped := &bufferedConn{Conn: conn}
+	tcp, ok := tcpConn(wrapped)
+	if !ok {
+		t.Fatalf("tcpConn(%T) found no *net.TCPConn", wrapped)
+	}
+	if err := setKeepAlive(tcp, 30*time.Second); err != nil {
+		t.Errorf("setKeepAlive: %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"time"
+)
+
+// removeStaleSocket removes the Unix socket file at path if no server is
+// listening on it. It fails if the socket is in use or path is some other
+// kind of file.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %s is already in use", path)
+	}
+
+	Logger.Info("removing stale socket", "event", "listen", "addr", path)
+	return os.Remove(path)
+}